@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -13,14 +15,20 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	proxy "github.com/deepk777/go-proxy/goproxy"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/peterbourgon/ff"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -31,27 +39,117 @@ const (
 	DefaultSocket = "127.0.0.1:514"
 )
 
+// FileDescriptorName of systemd sockets per listener role
+const (
+	SocketTask       = "task"
+	SocketMonitoring = "monitoring"
+	SocketGRPC       = "grpc"
+)
+
+// Subcommands, serve runs when none is given
+const (
+	CommandServe       = "serve"
+	CommandCheckConfig = "check-config"
+	CommandVersion     = "version"
+	CommandProbe       = "probe"
+)
+
 func main() {
 
-	fs := flag.NewFlagSet("go-proxy", flag.ExitOnError)
+	command, args := CommandServe, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	fs := flag.NewFlagSet("go-proxy "+command, flag.ExitOnError)
+	fs.Usage = func() { usage(fs) }
 	var (
+		configPath     = fs.String("config", "", "Path of the YAML (.yaml, .yml) or TOML (.toml) configuration file, other files are read in the deprecated \"flag value\" format. Flags and environment variables take precedence")
 		tlsPort        = fs.String("tls-port", "443", "HTTPS listen address")
 		monitoringPort = fs.String("monitoring-port", "5000", "HTTPS listen address")
-		logLevel       = fs.String("log-level", "info", "Enable verbose log level.")
-		logOut         = fs.String("log-output", "stdout", "Log output location. \n Valid options file, socket, stdout")
-		logConnAddr    = fs.String("log-conn-addr", DefaultSocket, "Socket (address:port) of where to send logs")
+		logLevel       = fs.String("log-level", "info", "Log level: debug, info, warn or error")
+		logOut         = fs.String("log-output", "stdout", "Comma separated log outputs. \n Valid options file, socket, syslog, stdout")
+		logConnAddr    = fs.String("log-conn-addr", DefaultSocket, "Socket (address:port) of where to send logs, for the socket and syslog outputs")
 		caCertsDir     = fs.String("ca-certs-dir", "", "Path of directory having list of allowed Certificate Authorities")
 		serverCert     = fs.String("server-cert-path", "", "Path for Server crt")
 		serverKey      = fs.String("server-key-path", "", "Path for Server key")
 		upstreamPort   = fs.String("upstream-port", "12000", "Denotes the port on which upstream service is running")
 		logDirectory   = fs.String("logdir", "/var/log/goproxy", "Log output directory")
+		logSinkLevels  = fs.String("log-output-levels", "", "Comma separated output=level pairs, an output logs every record passing log-level by default")
+		logMaxBytes    = fs.Int64("log-max-bytes", 0, "Size in bytes at which goproxy.log is rotated, 0 disables")
+		logRotateEvery = fs.Duration("log-rotate-interval", 0, "Interval at which goproxy.log is rotated, e.g. 24h, 0 disables")
+		logMaxBackups  = fs.Int("log-max-backups", 7, "Number of rotated log files to keep")
+		logMaxAge      = fs.Duration("log-max-age", 0, "Age after which rotated log files are removed, 0 keeps them")
+		logCompress    = fs.Bool("log-compress", false, "Gzip rotated log files")
+		accessLogPath  = fs.String("access-log", "", "Path of the HTTP access log of both listeners, stdout, or empty to disable it. Rotated like goproxy.log")
+		accessLogFmt   = fs.String("access-log-format", "combined", "Access log format: combined, json, or a Go template over AccessLogEntry")
+		syslogNetwork  = fs.String("syslog-network", "udp", "Transport of the syslog output: udp, tcp or tls")
+		syslogFormat   = fs.String("syslog-format", "rfc5424", "Message format of the syslog output: rfc5424 or rfc3164")
+		syslogFacility = fs.String("syslog-facility", "local0", "Facility of syslog messages")
+		syslogQueue    = fs.Int("syslog-queue-size", 10000, "Messages held while the syslog collector is unreachable, the oldest are dropped beyond")
+		syslogCAFile   = fs.String("syslog-ca-file", "", "CA certificate verifying the syslog collector over tls, system roots by default")
+		cacheMaxBytes  = fs.Int64("cache-max-bytes", 0, "Maximum size in bytes of the response cache, 0 disables caching")
+		cacheTargets   = fs.String("cache-targets", "", "Comma separated target=ttl pairs whose responses may be cached")
+		cacheKeyHeader = fs.String("cache-key-headers", "Authorization", "Comma separated request headers included in the cache key")
+		auditLog       = fs.String("audit-log", "", "Path of the JSON-lines audit log, empty disables auditing")
+		auditMaxBytes  = fs.Int64("audit-max-bytes", 100<<20, "Size in bytes at which the audit log is rotated")
+		auditBackups   = fs.Int("audit-max-backups", 10, "Number of rotated audit logs to keep")
+		auditBody      = fs.Bool("audit-include-body", false, "Include the redacted task body in audit records")
+		auditHashChain = fs.Bool("audit-hash-chain", false, "Chain audit records by hash for tamper evidence")
+		redactPaths    = fs.String("redact-paths", "$..password,$..token,$..secret", "Comma separated JSON paths masked in logged payloads")
+		redactPatterns = patternsVar(fs, "redact-patterns", "Regular expression masked in logged payloads, repeat the flag for more patterns")
+		redactHeaders  = fs.String("redact-headers", "Authorization", "Comma separated request headers masked in logs, Authorization is always masked")
+		logMaxPayload  = fs.Int("log-max-payload", 4096, "Maximum size in bytes of a logged payload, 0 means unlimited")
+		requestIDNode  = fs.String("request-id-prefix", "", "Node identifier prefixed to generated x-request-id values")
+		otlpEndpoint   = fs.String("otlp-endpoint", "", "OTLP/HTTP collector base URL spans are exported to, empty disables export")
+		grpcPort       = fs.String("grpc-port", "", "gRPC listen address, empty disables the gRPC server")
+		streamIdle     = fs.Duration("stream-idle-timeout", 60*time.Second, "Idle time after which /task/stream connections are closed, 0 disables the timeout")
+		streamMaxBytes = fs.Int64("stream-max-message-bytes", 1<<20, "Maximum size in bytes of a /task/stream message or event, 0 means unlimited")
+		taskListen     = fs.String("task-listen", "", "Comma separated [tcp|tcp4|tcp6|unix]://address listeners of the mutual TLS task API, default tcp4 on tls-port")
+		monitorListen  = fs.String("monitoring-listen", "", "Comma separated [tcp|tcp4|tcp6|unix]://address listeners of the health checks and /version, default tcp4 on monitoring-port")
+		monitorPlain   = fs.Bool("monitoring-plaintext", false, "Serve the monitoring listeners without TLS, only allowed on loopback addresses and unix sockets")
+		socketMode     = fs.String("socket-mode", "0660", "File mode of unix listener sockets")
+		adminToken     = fs.String("admin-token", "", "Bearer token required by the admin API on the monitoring listener, empty disables the admin API")
+		upgradeTimeout = fs.Duration("upgrade-timeout", 30*time.Second, "Time the process started by SIGUSR2 has to become ready before the upgrade is abandoned")
+		drainTimeout   = fs.Duration("shutdown-timeout", 30*time.Second, "Time in-flight requests are given to complete on shutdown or after an upgrade")
+		upstreamProtos = fs.String("upstream-protocols", "", "Comma separated target=protocol pairs, protocol is http1, h2, h2c or grpc:/package.Service/Method")
+		upstreamTimes  = fs.String("upstream-timeouts", "", "Comma separated target=timeout pairs replacing the default upstream timeout of 300s")
+		upstreamHeader = fs.String("upstream-headers", "", "Comma separated target:Header=value entries set on the tasks forwarded to a target")
+		readyTargets   = fs.String("ready-targets", "", "Comma separated targets whose upstream health check must pass for /readyz")
+		readyInFlight  = fs.Int("ready-max-in-flight", 0, "Requests in flight at which /readyz fails, 0 disables the limit")
+		certWarnDays   = fs.String("cert-warn-days", "30,14,7,1", "Comma separated days before expiry at which a certificate warning is logged, the largest also makes /readyz warn")
+		certReadyDays  = fs.Int("cert-ready-days", 0, "Days before expiry of the server certificate or a CA at which /readyz fails, 0 fails it on expiry only")
+		certCheckEvery = fs.Duration("cert-check-interval", time.Hour, "Interval at which certificate expiry is checked against cert-warn-days")
 	)
 
-	ff.Parse(fs, os.Args[1:],
-		ff.WithConfigFileFlag("config"),
-		ff.WithConfigFileParser(ff.PlainParser),
-		ff.WithEnvVarNoPrefix(),
-	)
+	switch command {
+	case CommandServe, CommandCheckConfig, CommandProbe:
+	case CommandVersion:
+		printVersion(os.Stdout)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := parseFlags(fs, args, configPath); err != nil {
+		if command != CommandServe {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		logAndExit(log.NewJSONLogger(os.Stderr), err)
+	}
+
+	switch {
+	case command == CommandCheckConfig:
+		os.Exit(checkConfig(fs, *serverCert, *caCertsDir))
+	case command == CommandProbe && fs.NArg() == 1:
+		os.Exit(probe(fs.Arg(0), ":"+*upstreamPort, *caCertsDir, *upstreamProtos, *upstreamTimes, *upstreamHeader))
+	case fs.NArg() > 0 || command == CommandProbe:
+		fs.Usage()
+		os.Exit(2)
+	}
 
 	ctx := context.Background()
 	errChan := make(chan error)
@@ -67,9 +165,60 @@ func main() {
 	upstreamEndpointPort := ":" + httpsAddress
 
 	// Initialize logger
-	logger, err := logSetup(*logOut, *logLevel, *logConnAddr, *logDirectory)
+	logLevels := proxy.NewLogLevels(strings.ToLower(*logLevel))
+	sinkLevels, err := parseKeyValues(*logSinkLevels)
 	if err != nil {
-		logAndExit(logger, err)
+		logAndExit(log.NewJSONLogger(os.Stderr), err)
+	}
+	var syslogTLS *tls.Config
+	if *syslogNetwork == proxy.SyslogTLS {
+		if syslogTLS, err = configureSyslogTLS(*syslogCAFile); err != nil {
+			logAndExit(log.NewJSONLogger(os.Stderr), err)
+		}
+	}
+	logRotate := proxy.RotateConfig{
+		MaxBytes:   *logMaxBytes,
+		Interval:   *logRotateEvery,
+		MaxBackups: *logMaxBackups,
+		MaxAge:     *logMaxAge,
+		Compress:   *logCompress,
+	}
+	logger, syslog, closeLogs, err := logSetup(logOptions{
+		outputs:    splitList(*logOut),
+		levels:     logLevels,
+		sinkLevels: sinkLevels,
+		connAddr:   *logConnAddr,
+		directory:  *logDirectory,
+		rotate:     logRotate,
+		syslog: proxy.SyslogConfig{
+			Network:   *syslogNetwork,
+			Address:   *logConnAddr,
+			Format:    *syslogFormat,
+			Facility:  *syslogFacility,
+			AppName:   "go-proxy",
+			TLSConfig: syslogTLS,
+			QueueSize: *syslogQueue,
+		},
+	})
+	if err != nil {
+		logAndExit(log.NewJSONLogger(os.Stderr), err)
+	}
+	defer closeLogs()
+
+	var accessLog *proxy.AccessLog
+	if *accessLogPath != "" {
+		var w io.Writer = os.Stdout
+		if *accessLogPath != "stdout" {
+			fp, err := proxy.OpenLogFile(*accessLogPath, logRotate)
+			if err != nil {
+				logAndExit(logger, err)
+			}
+			defer fp.Close()
+			w = fp
+		}
+		if accessLog, err = proxy.NewAccessLog(w, *accessLogFmt); err != nil {
+			logAndExit(logger, err)
+		}
 	}
 
 	caFiles, err := filePathWalkDir(*caCertsDir)
@@ -81,91 +230,499 @@ func main() {
 		logAndExit(logger, err)
 	}
 
-	service, err := proxy.NewService(ctx, upstreamEndpointPort, upstreamClient)
+	redactor, err := proxy.NewRedactor(proxy.RedactConfig{
+		Paths:           splitList(*redactPaths),
+		Patterns:        *redactPatterns,
+		Headers:         splitList(*redactHeaders),
+		MaxPayloadBytes: *logMaxPayload,
+	})
+	if err != nil {
+		logAndExit(logger, err)
+	}
+
+	upstreamTargets, err := parseUpstreamTargets(*upstreamProtos, *upstreamTimes, *upstreamHeader)
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	upstreams, err := proxy.NewUpstreams(caFiles, upstreamTargets)
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	defer upstreams.Close()
+	upstreams.CountConnections(upstreamClient)
+	probeTarget := func(ctx context.Context, target string) (int, error) {
+		return proxy.ProbeUpstream(ctx, target, upstreamEndpointPort, upstreamClient, upstreams)
+	}
+
+	certificates, err := proxy.LoadedCertificates(*serverCert, caFiles)
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	warnDays, err := proxy.ParseCertWarnDays(splitList(*certWarnDays))
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	certMonitor := proxy.NewCertMonitor(proxy.CertMonitorConfig{
+		Certificates: certificates,
+		WarnDays:     warnDays,
+		ReadyDays:    *certReadyDays,
+		Interval:     *certCheckEvery,
+	}, logger)
+	upstreams.ObserveCertificates(upstreamClient, certMonitor)
+	go certMonitor.Run(ctx)
+	tracker := proxy.NewTracker()
+	health := proxy.NewHealth(proxy.HealthConfig{
+		Certificates:    certMonitor,
+		RequiredTargets: splitList(*readyTargets),
+		Probe:           probeTarget,
+		Tracker:         tracker,
+		MaxInFlight:     *readyInFlight,
+		Syslog:          syslog,
+	})
+
+	build := proxy.ReadBuildInfo(enabledFeatures(map[string]bool{
+		"access-log": *accessLogPath != "",
+		"admin":      *adminToken != "",
+		"audit":      *auditLog != "",
+		"cache":      *cacheMaxBytes > 0,
+		"grpc":       *grpcPort != "",
+		"syslog":     syslog != nil,
+		"tracing":    *otlpEndpoint != "",
+	}))
+	level.Info(logger).Log(
+		"msg", "starting",
+		"version", build.Version,
+		"commit", build.Commit,
+		"build_date", build.BuildDate,
+		"dirty", build.Dirty,
+		"go_version", build.GoVersion,
+		"platform", build.Platform,
+		"features", strings.Join(build.Features, ","),
+		"pid", os.Getpid(),
+	)
+
+	service, err := proxy.NewService(ctx, upstreamEndpointPort, upstreamClient, upstreams, health, build)
 	if err != nil {
 		logAndExit(logger, err)
 	}
 	level.Debug(logger).Log("msg", "service initialized")
-	service = proxy.ServiceLoggingMiddleware(logger)(service)
+
+	// cache hits are neither tracked nor refused while a target drains
+	service = proxy.ServiceTrackingMiddleware(tracker)(service)
+
+	if *cacheMaxBytes > 0 {
+		targetTTL, err := parseTargetDurations(*cacheTargets)
+		if err != nil {
+			logAndExit(logger, err)
+		}
+		cache := proxy.NewResponseCache(proxy.CacheConfig{
+			MaxBytes:   *cacheMaxBytes,
+			TargetTTL:  targetTTL,
+			KeyHeaders: splitList(*cacheKeyHeader),
+		})
+		service = proxy.ServiceCachingMiddleware(cache)(service)
+		level.Debug(logger).Log("msg", "response cache enabled")
+	}
+
+	if *auditLog != "" {
+		auditor, err := proxy.NewAuditor(proxy.AuditConfig{
+			Path:        *auditLog,
+			MaxBytes:    *auditMaxBytes,
+			MaxBackups:  *auditBackups,
+			IncludeBody: *auditBody,
+			Redactor:    redactor,
+			HashChain:   *auditHashChain,
+		}, logger)
+		if err != nil {
+			logAndExit(logger, err)
+		}
+		defer auditor.Close()
+		service = proxy.ServiceAuditMiddleware(auditor)(service)
+		level.Debug(logger).Log("msg", "audit log enabled", "path", *auditLog)
+	}
+	service = proxy.ServiceLoggingMiddleware(logger, redactor)(service)
+
+	tracer := proxy.NewTracer("go-proxy", *otlpEndpoint, logger)
+	defer tracer.Close()
 
 	//Endpoints
 	endpoints := proxy.MakeProxyServiceEndpoints(service)
-	endpoints = proxy.MakeEndpointMiddlewares(endpoints, logger)
+	endpoints = proxy.MakeEndpointMiddlewares(endpoints, logger, redactor, tracer)
 	level.Debug(logger).Log("msg", "endpoint middlewares installed")
 
 	//HTTP Transport
-	mutualTLSHandler, nonMutualTLSHandler := proxy.MakeHTTPHandler(endpoints)
+	if err := proxy.CheckRequestIDPrefix(*requestIDNode); err != nil {
+		logAndExit(logger, err)
+	}
+	streamHandler := proxy.NewStreamHandler(proxy.StreamConfig{
+		UpstreamPort:    upstreamEndpointPort,
+		IdleTimeout:     *streamIdle,
+		MaxMessageBytes: *streamMaxBytes,
+		Tracker:         tracker,
+	}, upstreams, logger, redactor, tracer)
+	var adminHandler http.Handler
+	if *adminToken != "" {
+		adminHandler = proxy.NewAdminHandler(proxy.AdminConfig{
+			Token:        *adminToken,
+			LogLevels:    logLevels,
+			Syslog:       syslog,
+			Tracker:      tracker,
+			Upstreams:    upstreams,
+			Probe:        probeTarget,
+			Certificates: certMonitor,
+		}, logger)
+	}
+	mutualTLSHandler, nonMutualTLSHandler := proxy.MakeHTTPHandler(endpoints, proxy.HTTPConfig{
+		RequestIDPrefix: *requestIDNode,
+		StreamHandler:   streamHandler,
+		AdminHandler:    adminHandler,
+		MetricsHandler:  certMonitor.MetricsHandler(),
+		AccessLog:       accessLog,
+	})
 
-	go func() {
-		level.Info(logger).Log("serverStatus", "listening", "port", defaultEndpointPort)
+	taskAddresses, err := parseListenAddresses(*taskListen, proxy.ListenAddress{Network: "tcp4", Address: defaultEndpointPort})
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	monitoringAddresses, err := parseListenAddresses(*monitorListen, proxy.ListenAddress{Network: "tcp4", Address: monitoringEndpointPort})
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		logAndExit(logger, fmt.Errorf("invalid socket mode %q: %v", *socketMode, err))
+	}
 
-		// MutualTLS setup
-		tlsConfig, err := configureMutualTLS(caFiles, *serverCert, *serverKey)
-		if err != nil {
+	// MutualTLS setup
+	mutualTLSConfig, err := configureMutualTLS(caFiles, *serverCert, *serverKey)
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	serverTLSConfig, err := configureServerTLS(*serverCert, *serverKey)
+	if err != nil {
+		logAndExit(logger, err)
+	}
+
+	// Sockets passed by systemd socket activation or by an upgrade replace
+	// the listeners configured for their role, named by FileDescriptorName.
+	activated, err := proxy.SystemdListeners()
+	if err == nil && activated == nil {
+		activated, err = proxy.InheritedListeners()
+	}
+	if err != nil {
+		logAndExit(logger, err)
+	}
+	for name, ls := range activated {
+		switch name {
+		case SocketTask, SocketMonitoring, SocketGRPC:
+			level.Info(logger).Log("msg", "using inherited listeners", "role", name, "count", len(ls))
+		default:
+			level.Warn(logger).Log("msg", "ignoring inherited listeners with unknown name", "name", name)
+			closeListeners(ls)
+		}
+	}
+
+	taskListeners := activated[SocketTask]
+	if len(taskListeners) == 0 {
+		if taskListeners, err = listenAll(taskAddresses, os.FileMode(mode)); err != nil {
 			logAndExit(logger, err)
 		}
-		l, err := tls.Listen("tcp4", defaultEndpointPort, tlsConfig)
-		if err != nil {
+	}
+	monitoringListeners := activated[SocketMonitoring]
+	if len(monitoringListeners) == 0 {
+		if monitoringListeners, err = listenAll(monitoringAddresses, os.FileMode(mode)); err != nil {
 			logAndExit(logger, err)
 		}
-		errChan <- http.Serve(l, mutualTLSHandler)
+	}
+	grpcListeners := activated[SocketGRPC]
+	if len(grpcListeners) == 0 && *grpcPort != "" {
+		addr := proxy.ListenAddress{Network: "tcp4", Address: ":" + *grpcPort}
+		if grpcListeners, err = listenAll([]proxy.ListenAddress{addr}, os.FileMode(mode)); err != nil {
+			logAndExit(logger, err)
+		}
+	}
 
-	}()
+	// listeners are closed on exit so that unix socket files are removed
+	defer closeListeners(taskListeners)
+	defer closeListeners(monitoringListeners)
+	defer closeListeners(grpcListeners)
 
-	go func() {
-		level.Info(logger).Log("serverStatus", "listening", "port", monitoringEndpointPort)
+	if *monitorPlain {
+		for _, l := range monitoringListeners {
+			addr := proxy.ListenAddress{Network: l.Addr().Network(), Address: l.Addr().String()}
+			if !addr.Loopback() {
+				logAndExit(logger, fmt.Errorf("plaintext monitoring listener %s is not limited to localhost", addr))
+			}
+		}
+	}
 
-		tlsConfig, err := configureServerTLS(*serverCert, *serverKey)
-		if err != nil {
-			logAndExit(logger, err)
+	// servers are drained on shutdown and after an upgrade
+	var servers []*http.Server
+	serve := func(name string, l net.Listener, handler http.Handler) {
+		server := &http.Server{Handler: handler}
+		if accessLog != nil {
+			// failed TLS handshakes go to the access log
+			server.ErrorLog = accessLog.ErrorLog(name, logger)
 		}
-		l, err := tls.Listen("tcp4", monitoringEndpointPort, tlsConfig)
-		if err != nil {
-			logAndExit(logger, err)
+		servers = append(servers, server)
+		go func() {
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}()
+	}
+
+	for _, l := range taskListeners {
+		level.Info(logger).Log("serverStatus", "listening", "address", l.Addr())
+		serve(proxy.AccessLogTask, tls.NewListener(l, mutualTLSConfig), mutualTLSHandler)
+	}
+
+	for _, l := range monitoringListeners {
+		level.Info(logger).Log("serverStatus", "listening", "address", l.Addr(), "plaintext", *monitorPlain)
+		if !*monitorPlain {
+			l = tls.NewListener(l, serverTLSConfig)
 		}
-		errChan <- http.Serve(l, nonMutualTLSHandler)
-	}()
+		serve(proxy.AccessLogMonitoring, l, nonMutualTLSHandler)
+	}
+
+	var grpcServer *grpc.Server
+	if len(grpcListeners) > 0 {
+		// gRPC shares the MutualTLS setup of /task
+		grpcServer = proxy.MakeGRPCServer(endpoints, proxy.GRPCConfig{
+			RequestIDPrefix: *requestIDNode,
+		}, credentials.NewTLS(mutualTLSConfig))
+		for _, l := range grpcListeners {
+			level.Info(logger).Log("serverStatus", "listening", "address", l.Addr(), "transport", "grpc")
+			go func(l net.Listener) {
+				if err := grpcServer.Serve(l); err != nil {
+					errChan <- err
+				}
+			}(l)
+		}
+	}
 
+	// SIGUSR1 toggles debug logging. SIGUSR2 replaces this process by the
+	// binary now installed at its path, handing over the listeners without
+	// refusing connections.
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-c)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+		for sig := range c {
+			if sig == syscall.SIGUSR1 {
+				level.Info(logger).Log("msg", "log level changed", "log_level", logLevels.Toggle())
+				continue
+			}
+			if sig != syscall.SIGUSR2 {
+				errChan <- fmt.Errorf("%s", sig)
+				return
+			}
+			level.Info(logger).Log("msg", "upgrade requested")
+			pid, err := proxy.Upgrade(map[string][]net.Listener{
+				SocketTask:       taskListeners,
+				SocketMonitoring: monitoringListeners,
+				SocketGRPC:       grpcListeners,
+			}, *upgradeTimeout)
+			if err != nil {
+				level.Error(logger).Log("msg", "upgrade failed", "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "upgrade ready", "pid", pid)
+			// under systemd the new process takes over as main process
+			sdNotify(logger, fmt.Sprintf("MAINPID=%d", pid))
+			errChan <- proxy.ErrUpgraded
+			return
+		}
 	}()
 
-	level.Error(logger).Log("Error", <-errChan)
+	sdNotify(logger, proxy.SdNotifyReady)
+	if err := proxy.UpgradeReady(); err != nil {
+		level.Warn(logger).Log("msg", "upgrade readiness not sent", "err", err)
+	}
+	if interval := proxy.SdWatchdogInterval(); interval > 0 {
+		go func() {
+			for range time.Tick(interval / 2) {
+				sdNotify(logger, proxy.SdNotifyWatchdog)
+			}
+		}()
+	}
+
+	err = <-errChan
+	health.SetDraining()
+	if err == proxy.ErrUpgraded {
+		level.Info(logger).Log("msg", "draining", "timeout", *drainTimeout)
+	} else {
+		sdNotify(logger, proxy.SdNotifyStopping)
+		level.Error(logger).Log("Error", err)
+	}
+	drain(logger, *drainTimeout, servers, grpcServer)
 }
 
-func logSetup(logOut, logLevel, logConnAddr, logDirectory string) (log.Logger, error) {
+// drain stops the servers accepting connections and gives in-flight requests
+// up to timeout to complete
+func drain(logger log.Logger, timeout time.Duration, servers []*http.Server, grpcServer *grpc.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	var logger log.Logger
-	{
-		logger = log.NewJSONLogger(os.Stdout)
-		if logOut == "socket" {
-			conn, err := net.Dial(UDP, logConnAddr)
-			if err != nil {
-				return nil, err
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				level.Warn(logger).Log("msg", "in-flight requests cut off", "err", err)
 			}
-			logger = log.NewJSONLogger(conn)
-		} else if logOut == "file" {
-			logFilePath := path.Join(logDirectory, "goproxy.log")
-			fp, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return nil, err
+		}(server)
+	}
+	if grpcServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				level.Warn(logger).Log("msg", "in-flight gRPC calls cut off")
+				grpcServer.Stop()
 			}
-			logger = log.NewJSONLogger(fp)
+		}()
+	}
+	wg.Wait()
+}
+
+// sdNotify sends state to systemd, logging failures
+func sdNotify(logger log.Logger, state string) {
+	if _, err := proxy.SdNotify(state); err != nil {
+		level.Warn(logger).Log("msg", "sd_notify failed", "state", state, "err", err)
+	}
+}
+
+// listenAll opens a listener on every address
+func listenAll(addresses []proxy.ListenAddress, socketMode os.FileMode) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addresses {
+		l, err := proxy.Listen(addr, socketMode)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
 		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
 
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		logger = log.With(logger, "service", "go-proxy")
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
 
-		switch strings.ToLower(logLevel) {
-		case "debug":
-			logger = level.NewFilter(logger, level.AllowDebug())
+// logOptions holds the settings of the log outputs
+type logOptions struct {
+	outputs    []string
+	levels     *proxy.LogLevels
+	sinkLevels map[string]string
+	connAddr   string
+	directory  string
+	rotate     proxy.RotateConfig
+	syslog     proxy.SyslogConfig
+}
+
+// logSetup returns a logger writing to every output, and the syslog output
+// if enabled. The returned func closes the outputs.
+func logSetup(opts logOptions) (log.Logger, *proxy.SyslogLogger, func(), error) {
+
+	for out := range opts.sinkLevels {
+		if !contains(opts.outputs, out) {
+			return nil, nil, nil, fmt.Errorf("log level set for unused log output %q", out)
+		}
+	}
+
+	var sinks []log.Logger
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	var syslog *proxy.SyslogLogger
+	for _, out := range opts.outputs {
+		var sink log.Logger
+		switch out {
+		case "stdout":
+			sink = log.NewJSONLogger(os.Stdout)
+		case "socket":
+			conn, err := net.Dial(UDP, opts.connAddr)
+			if err != nil {
+				closeAll()
+				return nil, nil, nil, err
+			}
+			closers = append(closers, conn)
+			sink = log.NewJSONLogger(conn)
+		case "syslog":
+			var err error
+			if syslog, err = proxy.NewSyslogLogger(opts.syslog); err != nil {
+				closeAll()
+				return nil, nil, nil, err
+			}
+			closers = append(closers, syslog)
+			sink = syslog
+		case "file":
+			logFilePath := path.Join(opts.directory, "goproxy.log")
+			fp, err := proxy.OpenLogFile(logFilePath, opts.rotate)
+			if err != nil {
+				closeAll()
+				return nil, nil, nil, err
+			}
+			closers = append(closers, fp)
+			sink = log.NewJSONLogger(fp)
 		default:
-			logger = level.NewFilter(logger, level.AllowInfo())
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("invalid log output %q", out)
 		}
+
+		if lvl, ok := opts.sinkLevels[out]; ok {
+			var err error
+			if sink, err = proxy.MinLevelLogger(sink, lvl); err != nil {
+				closeAll()
+				return nil, nil, nil, fmt.Errorf("invalid level of log output %s: %v", out, err)
+			}
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, log.NewJSONLogger(os.Stdout))
 	}
-	return logger, nil
+
+	logger := proxy.FanoutLogger(sinks...)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+	logger = log.With(logger, "service", "go-proxy")
+
+	// the level can be changed at runtime, see -admin-token and SIGUSR1
+	logger = opts.levels.Logger(logger)
+	return logger, syslog, closeAll, nil
+}
+
+// configureSyslogTLS returns the TLS config of the syslog output, verifying
+// the collector with caFile when set
+func configureSyslogTLS(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates in syslog CA file %s", caFile)
+	}
+	return tlsConfig, nil
 }
 
 func filePathWalkDir(caDir string) ([]string, error) {
@@ -229,6 +786,343 @@ func configureMutualTLS(caFiles []string, serverCert, serverKey string) (*tls.Co
 	return tlsConfig, nil
 }
 
+// parseTargetDurations parses comma separated target=duration pairs
+func parseTargetDurations(s string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid target duration %q", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid target duration %q: %v", pair, err)
+		}
+		durations[strings.TrimSpace(kv[0])] = d
+	}
+	return durations, nil
+}
+
+// parseKeyValues parses comma separated key=value pairs
+func parseKeyValues(s string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
+}
+
+// parseListenAddresses parses comma separated listen addresses, returning
+// fallback when there are none.
+func parseListenAddresses(s string, fallback proxy.ListenAddress) ([]proxy.ListenAddress, error) {
+	var addresses []proxy.ListenAddress
+	for _, item := range splitList(s) {
+		addr, err := proxy.ParseListenAddress(item)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, addr)
+	}
+	if len(addresses) == 0 {
+		addresses = append(addresses, fallback)
+	}
+	return addresses, nil
+}
+
+// parseUpstreamTargets parses the comma separated target=protocol and
+// target=timeout pairs and target:Header=value entries of the upstream flags
+func parseUpstreamTargets(protocols, timeouts, headers string) (map[string]proxy.UpstreamTarget, error) {
+	targets := make(map[string]proxy.UpstreamTarget)
+	target := func(name string) proxy.UpstreamTarget {
+		if t, ok := targets[name]; ok {
+			return t
+		}
+		return proxy.UpstreamTarget{Protocol: proxy.ProtocolHTTP1}
+	}
+
+	for _, pair := range splitList(protocols) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid upstream protocol %q", pair)
+		}
+		parsed, err := proxy.ParseUpstreamTarget(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream protocol %q: %v", pair, err)
+		}
+		name := strings.TrimSpace(kv[0])
+		t := target(name)
+		t.Protocol, t.GRPCMethod = parsed.Protocol, parsed.GRPCMethod
+		targets[name] = t
+	}
+
+	durations, err := parseTargetDurations(timeouts)
+	if err != nil {
+		return nil, err
+	}
+	for name, d := range durations {
+		t := target(name)
+		t.Timeout = d
+		targets[name] = t
+	}
+
+	for _, item := range splitList(headers) {
+		i := strings.Index(item, ":")
+		kv := strings.SplitN(item[i+1:], "=", 2)
+		if i <= 0 || len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid upstream header %q, expected target:Header=value", item)
+		}
+		name := strings.TrimSpace(item[:i])
+		t := target(name)
+		if t.Headers == nil {
+			t.Headers = make(http.Header)
+		}
+		t.Headers.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		targets[name] = t
+	}
+	return targets, nil
+}
+
+func usage(fs *flag.FlagSet) {
+	fmt.Fprint(fs.Output(), `Usage:
+  go-proxy [serve] [flags]         run the proxy
+  go-proxy check-config [flags]    validate the configuration and certificates, print the effective configuration
+  go-proxy probe [flags] <target>  run the upstream health check against target
+  go-proxy version                 print the build information
+
+Flags:
+`)
+	fs.PrintDefaults()
+}
+
+// checkConfig validates the configuration resolved from the flags,
+// environment and configuration file, and the certificates it refers to. It
+// prints the configuration with secrets masked and returns the exit code.
+func checkConfig(fs *flag.FlagSet, serverCert, caCertsDir string) int {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	config, err := proxy.ConfigFromFlags(values)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	out, err := yaml.Marshal(config.Masked())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(out)
+
+	var problems []string
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(*proxy.ConfigError).Problems...)
+	}
+
+	// certificates which can be read are listed with their validity
+	files := []string{serverCert}
+	if caFiles, err := filePathWalkDir(caCertsDir); err == nil {
+		files = append(files, caFiles...)
+	}
+	now := time.Now()
+	for _, file := range files {
+		certs, err := proxy.ReadCertificates(file)
+		if err != nil {
+			continue
+		}
+		for _, cert := range certs {
+			days := int(cert.NotAfter.Sub(now).Hours() / 24)
+			fmt.Fprintf(os.Stderr, "certificate %s: %s, valid until %s (%d days)\n", file, cert.Subject, cert.NotAfter.UTC().Format(time.RFC3339), days)
+			switch {
+			case now.After(cert.NotAfter):
+				problems = append(problems, fmt.Sprintf("certificate %s in %s expired on %s", cert.Subject, file, cert.NotAfter.UTC().Format(time.RFC3339)))
+			case now.Before(cert.NotBefore):
+				problems = append(problems, fmt.Sprintf("certificate %s in %s is not valid before %s", cert.Subject, file, cert.NotBefore.UTC().Format(time.RFC3339)))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintln(os.Stderr, (&proxy.ConfigError{Problems: problems}).Error())
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "configuration OK")
+	return 0
+}
+
+// probe runs the upstream health check against target with the TLS client
+// and per target settings of the proxy, and returns the exit code
+func probe(target, upstreamPort, caCertsDir, protocols, timeouts, headers string) int {
+	caFiles, err := filePathWalkDir(caCertsDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	upstreamClient, err := proxy.MakeTLSClient(caFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	targets, err := parseUpstreamTargets(protocols, timeouts, headers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	upstreams, err := proxy.NewUpstreams(caFiles, targets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer upstreams.Close()
+
+	begin := time.Now()
+	status, err := proxy.ProbeUpstream(context.Background(), target, upstreamPort, upstreamClient, upstreams)
+	took := time.Since(begin).Round(time.Microsecond)
+	protocol := upstreams.Target(target).Protocol
+	if err != nil {
+		fmt.Printf("%s%s (%s): unhealthy, status %d, took %s: %v\n", target, upstreamPort, protocol, status, took, err)
+		return 1
+	}
+	fmt.Printf("%s%s (%s): healthy, status %d, took %s\n", target, upstreamPort, protocol, status, took)
+	return 0
+}
+
+// enabledFeatures returns the names of the enabled features, sorted
+func enabledFeatures(features map[string]bool) []string {
+	enabled := []string{}
+	for name, on := range features {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
+
+// printVersion prints the build information of the binary and the versions
+// of the modules linked in
+func printVersion(w io.Writer) {
+	build := proxy.ReadBuildInfo(nil)
+	version := build.Version
+	if version == "" {
+		version = "(devel)"
+	}
+	fmt.Fprintf(w, "go-proxy %s\n", version)
+	if build.Commit != "" {
+		dirty := ""
+		if build.Dirty {
+			dirty = " (dirty)"
+		}
+		fmt.Fprintf(w, "commit %s%s\n", build.Commit, dirty)
+	}
+	if build.BuildDate != "" {
+		fmt.Fprintf(w, "build date %s\n", build.BuildDate)
+	}
+	fmt.Fprintf(w, "%s %s\n", build.GoVersion, build.Platform)
+	paths := make([]string, 0, len(build.Modules))
+	for path := range build.Modules {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(w, "  %s %s\n", path, build.Modules[path])
+	}
+}
+
+// parseFlags sets the flags from args, then from environment variables named
+// after them (log-level is read from LOG_LEVEL), then from the configuration
+// file at configPath. Each source only sets the flags left unset by the ones
+// before it.
+func parseFlags(fs *flag.FlagSet, args []string, configPath *string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	provided := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		provided[f.Name] = true
+	})
+
+	var errs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if provided[f.Name] {
+			return
+		}
+		key := strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value := os.Getenv(key); value != "" {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid value of %s: %v", key, err))
+			}
+			provided[f.Name] = true
+		}
+	})
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	if *configPath == "" {
+		return nil
+	}
+	config, err := proxy.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if proxy.LegacyConfigFile(*configPath) {
+		fmt.Fprintf(os.Stderr, "warning: %s is in the deprecated \"flag value\" format, convert it to YAML or TOML with check-config\n", *configPath)
+	}
+	for name, value := range config.FlagValues() {
+		if provided[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value of %s in %s: %v", name, *configPath, err)
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// patternList is a repeatable flag of regular expressions, which may contain
+// commas. A value set from the environment or the configuration file holds
+// one pattern per line.
+type patternList []string
+
+func patternsVar(fs *flag.FlagSet, name, usage string) *patternList {
+	p := new(patternList)
+	fs.Var(p, name, usage)
+	return p
+}
+
+func (p *patternList) String() string {
+	return strings.Join(*p, "\n")
+}
+
+func (p *patternList) Set(value string) error {
+	*p = append(*p, proxy.SplitPatternList(value)...)
+	return nil
+}
+
+func contains(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func logAndExit(logger log.Logger, err error) {
 	level.Error(logger).Log("msg", err)
 	os.Exit(1)
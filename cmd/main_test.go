@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFlagsPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goproxy.yaml")
+	content := "logging:\n  level: debug\n  max_payload: 10\nupstream:\n  port: \"13000\"\nredact:\n  patterns: ['\\d{3,4}-\\d{4}', secret]\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want map[string]string
+	}{
+		{
+			name: "file",
+			args: []string{"-config", path},
+			want: map[string]string{"log-level": "debug", "log-max-payload": "10", "upstream-port": "13000", "redact-patterns": `\d{3,4}-\d{4}` + "\nsecret"},
+		},
+		{
+			name: "environment over file",
+			args: []string{"-config", path},
+			env:  map[string]string{"LOG_LEVEL": "warn", "REDACT_PATTERNS": "a,b\nc"},
+			want: map[string]string{"log-level": "warn", "log-max-payload": "10", "upstream-port": "13000", "redact-patterns": "a,b\nc"},
+		},
+		{
+			name: "flags over environment and file",
+			args: []string{"-config", path, "-log-level", "error", "-redact-patterns", "x{1,2}", "-redact-patterns", "y"},
+			env:  map[string]string{"LOG_LEVEL": "warn", "UPSTREAM_PORT": "14000"},
+			want: map[string]string{"log-level": "error", "log-max-payload": "10", "upstream-port": "14000", "redact-patterns": "x{1,2}\ny"},
+		},
+		{
+			name: "no file",
+			args: []string{"-upstream-port", "15000"},
+			want: map[string]string{"log-level": "info", "log-max-payload": "0", "upstream-port": "15000", "redact-patterns": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			fs := flag.NewFlagSet("go-proxy", flag.ContinueOnError)
+			configPath := fs.String("config", "", "")
+			fs.String("log-level", "info", "")
+			fs.Int("log-max-payload", 0, "")
+			fs.String("upstream-port", "12000", "")
+			patternsVar(fs, "redact-patterns", "")
+
+			if err := parseFlags(fs, tt.args, configPath); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("-%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goproxy.conf")
+	if err := ioutil.WriteFile(path, []byte("log-levle debug\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{name: "invalid environment variable", env: map[string]string{"LOG_MAX_PAYLOAD": "many"}, want: "invalid value of LOG_MAX_PAYLOAD"},
+		{name: "invalid file", args: []string{"-config", path}, want: `unknown flag "log-levle"`},
+		{name: "missing file", args: []string{"-config", filepath.Join(dir, "missing.yaml")}, want: "missing.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			fs := flag.NewFlagSet("go-proxy", flag.ContinueOnError)
+			configPath := fs.String("config", "", "")
+			fs.String("log-level", "info", "")
+			fs.Int("log-max-payload", 0, "")
+
+			err := parseFlags(fs, tt.args, configPath)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
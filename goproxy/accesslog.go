@@ -0,0 +1,289 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Access log formats, any other format is a text/template over AccessLogEntry
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// Listener names in the access log
+const (
+	AccessLogTask       = "task"
+	AccessLogMonitoring = "monitoring"
+)
+
+// combinedTemplate is the Apache/NGINX combined log format, with the client
+// certificate CN as user
+const combinedTemplate = `{{.RemoteHost}} - {{or .ClientCN "-"}} [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{.BytesOut}} "{{or .Referer "-"}}" "{{or .UserAgent "-"}}"`
+
+const tlsHandshakeErrorPrefix = "http: TLS handshake error from "
+
+// AccessLogEntry is a single request, or a failed TLS handshake, in the access log
+type AccessLogEntry struct {
+	Time       time.Time
+	Listener   string
+	RemoteAddr string
+	RemoteHost string
+	Method     string
+	URI        string
+	Proto      string
+	Status     int
+	BytesIn    int64
+	BytesOut   int64
+	Duration   time.Duration
+	RequestID  string
+	UserAgent  string
+	Referer    string
+	TLSVersion string
+	TLSCipher  string
+	ClientCN   string
+	// Error is set for failed TLS handshakes, which have no request.
+	Error string
+}
+
+// AccessLog writes an entry for every HTTP request, including requests
+// rejected by the router or the decoders, which never reach the endpoint
+// logging middleware.
+type AccessLog struct {
+	tmpl *template.Template
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLog returns an access log writing to w in format
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	a := &AccessLog{w: w}
+	switch format {
+	case AccessLogJSON:
+		return a, nil
+	case AccessLogCombined:
+		format = combinedTemplate
+	}
+	tmpl, err := template.New("access-log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log format: %v", err)
+	}
+	// check the template against an entry before the first request
+	if err := tmpl.Execute(ioutil.Discard, AccessLogEntry{}); err != nil {
+		return nil, fmt.Errorf("invalid access log format: %v", err)
+	}
+	a.tmpl = tmpl
+	return a, nil
+}
+
+// Handler logs the requests served by next on listener
+func (a *AccessLog) Handler(listener string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rw := &accessLogWriter{ResponseWriter: w}
+
+		next.ServeHTTP(rw, r)
+
+		entry := AccessLogEntry{
+			Time:       begin,
+			Listener:   listener,
+			RemoteAddr: r.RemoteAddr,
+			RemoteHost: remoteHost(r.RemoteAddr),
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     rw.status,
+			BytesIn:    body.n,
+			BytesOut:   rw.n,
+			Duration:   time.Since(begin),
+			RequestID:  RequestIDFromContext(r.Context()),
+			UserAgent:  r.UserAgent(),
+			Referer:    r.Referer(),
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if r.TLS != nil {
+			entry.TLSVersion = tlsVersionName(r.TLS.Version)
+			entry.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+			if len(r.TLS.PeerCertificates) > 0 {
+				entry.ClientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+			}
+		}
+		a.write(entry)
+	})
+}
+
+// ErrorLog returns a logger for http.Server.ErrorLog. Failed TLS handshakes
+// are written to the access log, other server errors to logger.
+func (a *AccessLog) ErrorLog(listener string, logger log.Logger) *stdlog.Logger {
+	return stdlog.New(writerFunc(func(p []byte) (int, error) {
+		msg := strings.TrimSpace(string(p))
+		if strings.HasPrefix(msg, tlsHandshakeErrorPrefix) {
+			rest := strings.TrimPrefix(msg, tlsHandshakeErrorPrefix)
+			addr, reason := rest, ""
+			if i := strings.Index(rest, ": "); i >= 0 {
+				addr, reason = rest[:i], rest[i+2:]
+			}
+			a.write(AccessLogEntry{
+				Time:       time.Now(),
+				Listener:   listener,
+				RemoteAddr: addr,
+				RemoteHost: remoteHost(addr),
+				Error:      "TLS handshake error: " + reason,
+			})
+			return len(p), nil
+		}
+		level.Error(logger).Log("msg", msg, "listener", listener)
+		return len(p), nil
+	}), "", 0)
+}
+
+func (a *AccessLog) write(entry AccessLogEntry) {
+	var buf bytes.Buffer
+	if a.tmpl != nil {
+		if entry.Method == "" {
+			entry.Method, entry.URI, entry.Proto = "-", "-", "-"
+		}
+		a.tmpl.Execute(&buf, entry)
+	} else {
+		json.NewEncoder(&buf).Encode(accessLogJSON(entry))
+	}
+	if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	a.mu.Lock()
+	a.w.Write(buf.Bytes())
+	a.mu.Unlock()
+}
+
+func accessLogJSON(e AccessLogEntry) map[string]interface{} {
+	m := map[string]interface{}{
+		"ts":          e.Time.UTC().Format(time.RFC3339Nano),
+		"listener":    e.Listener,
+		"remote_addr": e.RemoteAddr,
+	}
+	if e.Error != "" {
+		m["error"] = e.Error
+		return m
+	}
+	m["method"] = e.Method
+	m["uri"] = e.URI
+	m["proto"] = e.Proto
+	m["status"] = e.Status
+	m["bytes_in"] = e.BytesIn
+	m["bytes_out"] = e.BytesOut
+	m["duration_ms"] = float64(e.Duration) / float64(time.Millisecond)
+	m["x-request-id"] = e.RequestID
+	m["user_agent"] = e.UserAgent
+	m["referer"] = e.Referer
+	if e.TLSVersion != "" {
+		m["tls_version"] = e.TLSVersion
+		m["tls_cipher"] = e.TLSCipher
+		m["client_cn"] = e.ClientCN
+	}
+	return m
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	if addr == "" || addr == "@" {
+		// unix socket peers have no address
+		return "-"
+	}
+	return addr
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// accessLogWriter records the status and size of a response. It keeps the
+// Flusher and Hijacker of the underlying writer for /task/stream.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,372 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// AdminPathPrefix is where the admin API is mounted on the monitoring listener
+const AdminPathPrefix = "/admin/"
+
+// Limits of the duration of a log scope
+const (
+	defaultLogScopeDuration = 15 * time.Minute
+	maxLogScopeDuration     = 24 * time.Hour
+)
+
+// AdminConfig holds the settings of the admin API
+type AdminConfig struct {
+	// Token must be sent as bearer token in the Authorization header.
+	Token string
+	// LogLevels is changed by the log level endpoints.
+	LogLevels *LogLevels
+	// Syslog is the syslog log output, if enabled.
+	Syslog *SyslogLogger
+	// Tracker holds the requests in flight and the drain mode of targets.
+	Tracker *Tracker
+	// Upstreams lists the configured targets and the upstream connections.
+	Upstreams *Upstreams
+	// Probe runs the upstream health check of a target, for ?probe=true.
+	Probe func(ctx context.Context, target string) (int, error)
+	// Certificates holds the server certificate chain and CAs loaded at
+	// startup, and the certificates presented by upstream.
+	Certificates *CertMonitor
+}
+
+type adminHandler struct {
+	config AdminConfig
+	logger log.Logger
+}
+
+// NewAdminHandler returns the handler of the admin API. Every request must
+// carry config.Token.
+func NewAdminHandler(config AdminConfig, logger log.Logger) http.Handler {
+	h := &adminHandler{config: config, logger: logger}
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/admin/log-level").HandlerFunc(h.getLogLevel)
+	r.Methods("PUT").Path("/admin/log-level").HandlerFunc(h.putLogLevel)
+	r.Methods("POST").Path("/admin/log-level/scopes").HandlerFunc(h.addLogScope)
+	r.Methods("DELETE").Path("/admin/log-level/scopes").HandlerFunc(h.clearLogScopes)
+	r.Methods("GET").Path("/admin/log-outputs").HandlerFunc(h.getLogOutputs)
+	r.Methods("GET").Path("/admin/targets").HandlerFunc(h.getTargets)
+	r.Methods("GET").Path("/admin/targets/{target}").HandlerFunc(h.getTarget)
+	r.Methods("PUT").Path("/admin/targets/{target}/drain").HandlerFunc(h.drainTarget)
+	r.Methods("DELETE").Path("/admin/targets/{target}/drain").HandlerFunc(h.undrainTarget)
+	r.Methods("GET").Path("/admin/requests").HandlerFunc(h.getRequests)
+	r.Methods("GET").Path("/admin/connections").HandlerFunc(h.getConnections)
+	r.Methods("GET").Path("/admin/certificates").HandlerFunc(h.getCertificates)
+	return h.authenticate(r)
+}
+
+func (h *adminHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if h.config.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.config.Token)) != 1 {
+			h.error(w, r, ErrUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type logLevelBody struct {
+	Level  string     `json:"level"`
+	Scopes []LogScope `json:"scopes"`
+}
+
+func (h *adminHandler) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	h.respond(w, http.StatusOK, logLevelBody{
+		Level:  h.config.LogLevels.Level(),
+		Scopes: h.config.LogLevels.Scopes(),
+	})
+}
+
+func (h *adminHandler) putLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		h.error(w, r, ErrJSONUnMarshall.Wrap(err))
+		return
+	}
+	if err := h.config.LogLevels.SetLevel(body.Level); err != nil {
+		h.error(w, r, ErrMalformedRequest.Wrap(err))
+		return
+	}
+	level.Info(h.logger).Log("msg", "log level changed", "log_level", body.Level, "x-request-id", RequestIDFromContext(r.Context()))
+	h.getLogLevel(w, r)
+}
+
+// logScopeRequest is a LogScope with a duration instead of an expiry
+type logScopeRequest struct {
+	RequestID      string `json:"request_id"`
+	ClientIdentity string `json:"client_identity"`
+	Target         string `json:"target"`
+	Level          string `json:"level"`
+	Duration       string `json:"duration"`
+}
+
+func (h *adminHandler) addLogScope(w http.ResponseWriter, r *http.Request) {
+	var req logScopeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.error(w, r, ErrJSONUnMarshall.Wrap(err))
+		return
+	}
+	if req.Level == "" {
+		req.Level = LogLevelDebug
+	}
+	duration := defaultLogScopeDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxLogScopeDuration {
+			h.error(w, r, ErrMalformedRequest.Wrap(fmt.Errorf("duration must be between 0 and %s", maxLogScopeDuration)))
+			return
+		}
+		duration = d
+	}
+
+	scope := LogScope{
+		RequestID:      req.RequestID,
+		ClientIdentity: req.ClientIdentity,
+		Target:         req.Target,
+		Level:          req.Level,
+		Expires:        time.Now().Add(duration).UTC(),
+	}
+	if err := h.config.LogLevels.AddScope(scope); err != nil {
+		h.error(w, r, ErrMalformedRequest.Wrap(err))
+		return
+	}
+	level.Info(h.logger).Log(
+		"msg", "log scope added",
+		"log_level", scope.Level,
+		"scope_request_id", scope.RequestID,
+		"scope_client_identity", scope.ClientIdentity,
+		"scope_target", scope.Target,
+		"expires", scope.Expires,
+		"x-request-id", RequestIDFromContext(r.Context()),
+	)
+	h.respond(w, http.StatusCreated, scope)
+}
+
+func (h *adminHandler) clearLogScopes(w http.ResponseWriter, r *http.Request) {
+	h.config.LogLevels.ClearScopes()
+	level.Info(h.logger).Log("msg", "log scopes cleared", "x-request-id", RequestIDFromContext(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type syslogStatus struct {
+	Network   string `json:"network"`
+	Address   string `json:"address"`
+	Connected bool   `json:"connected"`
+	Queued    int    `json:"queued"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+func (h *adminHandler) getLogOutputs(w http.ResponseWriter, r *http.Request) {
+	body := map[string]interface{}{}
+	if s := h.config.Syslog; s != nil {
+		body["syslog"] = syslogStatus{
+			Network:   s.config.Network,
+			Address:   s.config.Address,
+			Connected: s.Connected(),
+			Queued:    s.Queued(),
+			Dropped:   s.Dropped(),
+		}
+	}
+	h.respond(w, http.StatusOK, body)
+}
+
+// targetStatus is the configuration and observed state of a target
+type targetStatus struct {
+	TargetState
+	Configured bool         `json:"configured"`
+	Protocol   string       `json:"protocol"`
+	Timeout    string       `json:"timeout"`
+	Probe      *probeResult `json:"probe,omitempty"`
+}
+
+type probeResult struct {
+	Healthy        bool   `json:"healthy"`
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+	Error          string `json:"error,omitempty"`
+	Took           string `json:"took"`
+}
+
+func (h *adminHandler) targetStatus(state TargetState, configured map[string]bool) targetStatus {
+	t := h.config.Upstreams.Target(state.Target)
+	timeout := DefaultTimeout
+	if t.Timeout > 0 {
+		timeout = t.Timeout
+	}
+	return targetStatus{
+		TargetState: state,
+		Configured:  configured[state.Target],
+		Protocol:    t.Protocol,
+		Timeout:     timeout.String(),
+	}
+}
+
+func (h *adminHandler) configuredTargets() map[string]bool {
+	configured := make(map[string]bool)
+	for _, name := range h.config.Upstreams.Targets() {
+		configured[name] = true
+	}
+	return configured
+}
+
+// getTargets lists the configured targets and those tasks were forwarded to.
+// With ?probe=true every target is health checked.
+func (h *adminHandler) getTargets(w http.ResponseWriter, r *http.Request) {
+	configured := h.configuredTargets()
+	seen := make(map[string]bool)
+	var targets []targetStatus
+	for _, state := range h.config.Tracker.Targets() {
+		seen[state.Target] = true
+		targets = append(targets, h.targetStatus(state, configured))
+	}
+	for name := range configured {
+		if !seen[name] {
+			targets = append(targets, h.targetStatus(h.config.Tracker.Target(name), configured))
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Target < targets[j].Target
+	})
+
+	probe, err := queryBool(r, "probe")
+	if err != nil {
+		h.error(w, r, ErrMalformedRequest.Wrap(err))
+		return
+	}
+	if probe {
+		var wg sync.WaitGroup
+		for i := range targets {
+			wg.Add(1)
+			go func(t *targetStatus) {
+				defer wg.Done()
+				t.Probe = h.probe(r.Context(), t.Target)
+			}(&targets[i])
+		}
+		wg.Wait()
+	}
+	h.respond(w, http.StatusOK, map[string]interface{}{"targets": targets})
+}
+
+func (h *adminHandler) getTarget(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["target"]
+	status := h.targetStatus(h.config.Tracker.Target(name), h.configuredTargets())
+
+	probe, err := queryBool(r, "probe")
+	if err != nil {
+		h.error(w, r, ErrMalformedRequest.Wrap(err))
+		return
+	}
+	if probe {
+		status.Probe = h.probe(r.Context(), name)
+	}
+	h.respond(w, http.StatusOK, status)
+}
+
+func (h *adminHandler) probe(ctx context.Context, target string) *probeResult {
+	if h.config.Probe == nil {
+		return nil
+	}
+	begin := time.Now()
+	status, err := h.config.Probe(ctx, target)
+	result := &probeResult{
+		Healthy:        err == nil,
+		UpstreamStatus: status,
+		Took:           time.Since(begin).String(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// drainTarget puts a target into drain mode: new tasks and streams to it are
+// refused with 503, those in flight complete
+func (h *adminHandler) drainTarget(w http.ResponseWriter, r *http.Request) {
+	h.setDraining(w, r, true)
+}
+
+func (h *adminHandler) undrainTarget(w http.ResponseWriter, r *http.Request) {
+	h.setDraining(w, r, false)
+}
+
+func (h *adminHandler) setDraining(w http.ResponseWriter, r *http.Request, draining bool) {
+	name := mux.Vars(r)["target"]
+	h.config.Tracker.SetDraining(name, draining)
+	level.Info(h.logger).Log("msg", "target drain mode changed", "target", name, "draining", draining, "x-request-id", RequestIDFromContext(r.Context()))
+	h.respond(w, http.StatusOK, h.targetStatus(h.config.Tracker.Target(name), h.configuredTargets()))
+}
+
+// inFlightRequest adds the age to an InFlightRequest
+type inFlightRequest struct {
+	InFlightRequest
+	Age string `json:"age"`
+}
+
+func (h *adminHandler) getRequests(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	requests := []inFlightRequest{}
+	for _, req := range h.config.Tracker.InFlight() {
+		requests = append(requests, inFlightRequest{
+			InFlightRequest: req,
+			Age:             now.Sub(req.Started).Round(time.Millisecond).String(),
+		})
+	}
+	h.respond(w, http.StatusOK, map[string]interface{}{"requests": requests})
+}
+
+func (h *adminHandler) getConnections(w http.ResponseWriter, r *http.Request) {
+	connections := h.config.Upstreams.Connections()
+	if connections == nil {
+		connections = []UpstreamConnections{}
+	}
+	h.respond(w, http.StatusOK, map[string]interface{}{"upstreams": connections})
+}
+
+func (h *adminHandler) getCertificates(w http.ResponseWriter, r *http.Request) {
+	certificates := []CertificateStatus{}
+	if h.config.Certificates != nil {
+		certificates = h.config.Certificates.Certificates()
+	}
+	h.respond(w, http.StatusOK, map[string]interface{}{"certificates": certificates})
+}
+
+// queryBool parses the query parameter name, false when it is not set
+func queryBool(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter %q", name, v)
+	}
+	return b, nil
+}
+
+func (h *adminHandler) respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (h *adminHandler) error(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := httptransport.PopulateRequestContext(r.Context(), r)
+	encodeErrorFrom(ctx, err, ErrorSourceProxy, w)
+}
@@ -0,0 +1,262 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// AuditConfig holds the settings of the audit trail
+type AuditConfig struct {
+	// Path of the JSON-lines audit file.
+	Path string
+	// MaxBytes is the size at which the audit file is rotated.
+	MaxBytes int64
+	// MaxBackups is the number of rotated files kept.
+	MaxBackups int
+	// IncludeBody adds the task body, masked by Redactor, to every record.
+	IncludeBody bool
+	Redactor    *Redactor
+	// HashChain links every record to the previous one for tamper evidence.
+	HashChain bool
+}
+
+// AuditRecord is a single line of the audit trail
+type AuditRecord struct {
+	Timestamp      string           `json:"ts"`
+	ClientIdentity string           `json:"client_identity,omitempty"`
+	SourceIPs      []string         `json:"source_ips,omitempty"`
+	RequestID      string           `json:"x-request-id"`
+	Target         string           `json:"target"`
+	TaskSHA256     string           `json:"task_sha256"`
+	Task           *json.RawMessage `json:"task,omitempty"`
+	UpstreamStatus int              `json:"upstream_status,omitempty"`
+	LatencyMS      float64          `json:"latency_ms"`
+	Cache          string           `json:"cache,omitempty"`
+	Error          string           `json:"error,omitempty"`
+	PrevHash       string           `json:"prev_hash,omitempty"`
+	Hash           string           `json:"hash,omitempty"`
+}
+
+// Auditor appends audit records to a size rotated file.
+type Auditor struct {
+	config AuditConfig
+	logger log.Logger
+
+	mu       sync.Mutex
+	file     *rotatingFile
+	lastHash string
+}
+
+// NewAuditor opens the audit file, resuming the hash chain from its last record.
+// A partial last record, left by a crash, is ignored.
+func NewAuditor(config AuditConfig, logger log.Logger) (*Auditor, error) {
+	tail, err := readAuditTail(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if tail.partial {
+		level.Warn(logger).Log("msg", "ignoring partial last record of audit log", "file", config.Path)
+		if err := terminateLine(config.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := openRotatingFile(config.Path, RotateConfig{
+		MaxBytes:   config.MaxBytes,
+		MaxBackups: config.MaxBackups,
+		ErrorHandler: func(err error) {
+			level.Error(logger).Log("msg", "failed to rotate audit log", "error_description", err.Error())
+		},
+	}, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Auditor{
+		config: config,
+		logger: logger,
+		file:   file,
+	}
+	if config.HashChain {
+		if a.lastHash, err = resumeHashChain(tail, file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Record appends rec to the audit trail
+func (a *Auditor) Record(rec AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.config.HashChain {
+		rec.PrevHash = a.lastHash
+		rec.Hash = ""
+		unsigned, err := json.Marshal(rec)
+		if err != nil {
+			level.Error(a.logger).Log("msg", "failed to encode audit record", "error_description", err.Error())
+			return
+		}
+		sum := sha256.Sum256(unsigned)
+		rec.Hash = hex.EncodeToString(sum[:])
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		level.Error(a.logger).Log("msg", "failed to encode audit record", "error_description", err.Error())
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		level.Error(a.logger).Log("msg", "failed to write audit record", "error_description", err.Error())
+		return
+	}
+	a.lastHash = rec.Hash
+}
+
+// Close closes the audit file
+func (a *Auditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+type auditMiddleware struct {
+	auditor *Auditor
+	next    Service
+}
+
+func (amw *auditMiddleware) ReceiveAndForward(ctx context.Context, request ReceiveAndForwardRequest) (output ReceiveAndForwardResponse, err error) {
+
+	defer func(begin time.Time) {
+		rec := AuditRecord{
+			Timestamp:      begin.UTC().Format(time.RFC3339Nano),
+			ClientIdentity: request.ClientIdentity,
+			RequestID:      request.RequestID,
+			Target:         request.Body.TargetURL,
+			UpstreamStatus: output.UpstreamStatus,
+			LatencyMS:      float64(time.Since(begin)) / float64(time.Millisecond),
+			Cache:          output.CacheStatus,
+		}
+
+		for _, ip := range strings.Split(request.XForwardedFor, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				rec.SourceIPs = append(rec.SourceIPs, ip)
+			}
+		}
+
+		sum := sha256.Sum256(request.Body.TaskBytes())
+		rec.TaskSHA256 = hex.EncodeToString(sum[:])
+
+		if amw.auditor.config.IncludeBody && request.Body.Task != nil {
+			rec.Task = amw.auditor.config.Redactor.JSON(request.Body.Task)
+		}
+
+		if err != nil {
+			rec.Error = amw.auditor.config.Redactor.String(err.Error())
+		}
+
+		amw.auditor.Record(rec)
+	}(time.Now())
+
+	output, err = amw.next.ReceiveAndForward(ctx, request)
+	return output, err
+}
+
+func (amw *auditMiddleware) HealthCheck(ctx context.Context, request HealthCheckRequest) (HealthCheckResponse, error) {
+	return amw.next.HealthCheck(ctx, request)
+}
+
+func (amw *auditMiddleware) Version(ctx context.Context) (VersionResponse, error) {
+	return amw.next.Version(ctx)
+}
+
+// resumeHashChain returns the hash the next record links to. When the audit
+// file holds no record yet, the chain continues from the newest backup, so it
+// is not broken at file boundaries.
+func resumeHashChain(tail auditTail, file *rotatingFile) (string, error) {
+	if tail.found || file.config.MaxBackups == 0 {
+		return tail.hash, nil
+	}
+	backup, err := readAuditTail(file.backup(1, false))
+	return backup.hash, err
+}
+
+// auditTail is the end of an audit file
+type auditTail struct {
+	// hash of the last complete record
+	hash string
+	// found is set when the file holds a complete record
+	found bool
+	// partial is set when the last line lacks its newline, the record was
+	// cut short by a crash
+	partial bool
+}
+
+// readAuditTail reads the end of the audit file at path. A partial last line
+// is skipped, any other invalid last record is an error.
+func readAuditTail(path string) (auditTail, error) {
+	var tail auditTail
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tail, nil
+		}
+		return tail, err
+	}
+	defer fp.Close()
+
+	var last []byte
+	reader := bufio.NewReader(fp)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			tail.partial = len(bytes.TrimSpace(line)) > 0
+			break
+		}
+		if err != nil {
+			return tail, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			last = line
+		}
+	}
+	if last == nil {
+		return tail, nil
+	}
+
+	var rec AuditRecord
+	if err := json.Unmarshal(last, &rec); err != nil {
+		return tail, fmt.Errorf("audit file %s: last record is not valid: %v", path, err)
+	}
+	tail.hash, tail.found = rec.Hash, true
+	return tail, nil
+}
+
+// terminateLine ends the partial last line of the file at path, so that the
+// next record starts on a line of its own
+func terminateLine(path string) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write([]byte("\n")); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
@@ -0,0 +1,193 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// readAuditChain returns the records of the audit files, oldest first, and
+// fails unless every record links to the one before
+func readAuditChain(t *testing.T, paths ...string) []AuditRecord {
+	t.Helper()
+	var records []AuditRecord
+	for _, path := range paths {
+		fp, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(fp)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue
+			}
+			records = append(records, rec)
+		}
+		fp.Close()
+	}
+
+	prev := ""
+	for i, rec := range records {
+		if rec.PrevHash != prev {
+			t.Errorf("record %d links to %q, want %q", i, rec.PrevHash, prev)
+		}
+		hash := rec.Hash
+		rec.Hash = ""
+		unsigned, _ := json.Marshal(rec)
+		sum := sha256.Sum256(unsigned)
+		if want := hex.EncodeToString(sum[:]); hash != want {
+			t.Errorf("record %d hash %q, want %q", i, hash, want)
+		}
+		prev = hash
+	}
+	return records
+}
+
+func TestAuditHashChain(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare writes to the audit file before the auditor is reopened
+		prepare func(t *testing.T, path string)
+		records int
+		files   func(path string) []string
+	}{
+		{
+			name:    "restart",
+			prepare: func(t *testing.T, path string) {},
+			records: 4,
+			files:   func(path string) []string { return []string{path} },
+		},
+		{
+			name: "partial last line",
+			prepare: func(t *testing.T, path string) {
+				fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fp.WriteString(`{"ts":"2020-01-01T00:00:00Z","x-request-`)
+				fp.Close()
+			},
+			records: 4,
+			files:   func(path string) []string { return []string{path} },
+		},
+		{
+			name: "rotated before restart",
+			prepare: func(t *testing.T, path string) {
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			records: 4,
+			files:   func(path string) []string { return []string{path + ".1", path} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "audit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "audit.log")
+			config := AuditConfig{Path: path, MaxBytes: 1 << 20, MaxBackups: 2, HashChain: true}
+
+			for run := 0; run < 2; run++ {
+				if run == 1 {
+					tt.prepare(t, path)
+				}
+				auditor, err := NewAuditor(config, log.NewNopLogger())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, id := range []string{"a", "b"} {
+					auditor.Record(AuditRecord{RequestID: id, Target: "worker-1"})
+				}
+				auditor.Close()
+			}
+
+			if records := readAuditChain(t, tt.files(path)...); len(records) != tt.records {
+				t.Errorf("%d records, want %d", len(records), tt.records)
+			}
+		})
+	}
+}
+
+func TestAuditHashChainAcrossRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	auditor, err := NewAuditor(AuditConfig{Path: path, MaxBytes: 300, MaxBackups: 10, HashChain: true}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		auditor.Record(AuditRecord{RequestID: strings.Repeat("x", 100), Target: "worker-1"})
+	}
+	auditor.Close()
+
+	var files []string
+	for i := 10; i > 0; i-- {
+		if _, err := os.Stat(auditor.file.backup(i, false)); err == nil {
+			files = append(files, auditor.file.backup(i, false))
+		}
+	}
+	if len(files) == 0 {
+		t.Fatal("audit log not rotated")
+	}
+	if records := readAuditChain(t, append(files, path)...); len(records) != 6 {
+		t.Errorf("%d records, want 6", len(records))
+	}
+}
+
+func TestReadAuditTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    auditTail
+		err     bool
+	}{
+		{"empty", "", auditTail{}, false},
+		{"blank lines", "\n\n", auditTail{}, false},
+		{"complete", `{"hash":"a"}` + "\n" + `{"hash":"b"}` + "\n", auditTail{hash: "b", found: true}, false},
+		{"trailing blank line", `{"hash":"a"}` + "\n\n", auditTail{hash: "a", found: true}, false},
+		{"partial", `{"hash":"a"}` + "\n" + `{"hash":"b`, auditTail{hash: "a", found: true, partial: true}, false},
+		{"only partial", `{"ha`, auditTail{partial: true}, false},
+		{"invalid complete line", `{"hash":"a"}` + "\n" + "garbage\n", auditTail{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp, err := ioutil.TempFile("", "audit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(fp.Name())
+			fp.WriteString(tt.content)
+			fp.Close()
+
+			got, err := readAuditTail(fp.Name())
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if !tt.err && got != tt.want {
+				t.Errorf("readAuditTail = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := readAuditTail(filepath.Join(os.TempDir(), "no-such-audit.log")); err != nil || got.found {
+		t.Errorf("missing file: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,97 @@
+package goproxy
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Set at link time like ProxyVersion, e.g.
+// -ldflags "-X github.com/deepk777/go-proxy/goproxy.ProxyCommit=$(git rev-parse HEAD)".
+// Binaries built from a git checkout fall back to the VCS stamp of the Go
+// toolchain, the revision and the commit time.
+var (
+	ProxyCommit    string
+	ProxyBuildDate string
+)
+
+// processStart is reported as start time by /version
+var processStart = time.Now()
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	// Dirty is set when the binary was built from a checkout with local changes.
+	Dirty     bool
+	GoVersion string
+	Platform  string
+	// Features are the optional features enabled by the configuration.
+	Features []string
+	// Modules are the versions of the modules linked in, by module path.
+	Modules map[string]string
+}
+
+// ReadBuildInfo returns the build information of the running binary, with
+// the enabled features
+func ReadBuildInfo(features []string) BuildInfo {
+	b := BuildInfo{
+		Version:   ProxyVersion,
+		Commit:    ProxyCommit,
+		BuildDate: ProxyBuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  features,
+	}
+	if b.Features == nil {
+		b.Features = []string{}
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	if b.Version == "" {
+		b.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if b.Commit == "" {
+				b.Commit = s.Value
+			}
+		case "vcs.time":
+			if b.BuildDate == "" {
+				b.BuildDate = s.Value
+			}
+		case "vcs.modified":
+			b.Dirty = s.Value == "true"
+		}
+	}
+	b.Modules = make(map[string]string, len(info.Deps))
+	for _, dep := range info.Deps {
+		version := dep.Version
+		if dep.Replace != nil {
+			version = dep.Replace.Path + " " + dep.Replace.Version
+		}
+		b.Modules[dep.Path] = version
+	}
+	return b
+}
+
+// versionResponse adds the start time and uptime of the process to b
+func versionResponse(b BuildInfo) VersionResponse {
+	return VersionResponse{
+		GoproxyVersion: b.Version,
+		Commit:         b.Commit,
+		BuildDate:      b.BuildDate,
+		Dirty:          b.Dirty,
+		GoVersion:      b.GoVersion,
+		Platform:       b.Platform,
+		Features:       b.Features,
+		Modules:        b.Modules,
+		StartTime:      processStart.UTC(),
+		Uptime:         time.Since(processStart).Round(time.Second).String(),
+	}
+}
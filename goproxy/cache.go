@@ -0,0 +1,335 @@
+package goproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// X-Cache header values
+const (
+	CacheHit  = "HIT"
+	CacheMiss = "MISS"
+)
+
+// CacheConfig holds the settings of the response cache
+type CacheConfig struct {
+	// MaxBytes bounds the total size of cached responses.
+	MaxBytes int64
+	// TargetTTL lists the targets taking part in caching along with the TTL
+	// used when upstream sends no Cache-Control or Expires header. A target
+	// with a zero TTL is cached only when upstream allows it explicitly.
+	TargetTTL map[string]time.Duration
+	// KeyHeaders are the request headers which become part of the cache key.
+	KeyHeaders []string
+}
+
+// ResponseCache is an in-memory LRU cache of upstream responses bounded by bytes.
+type ResponseCache struct {
+	config CacheConfig
+
+	mu      sync.Mutex
+	size    int64
+	ll      *list.List
+	entries map[string]*list.Element
+
+	flights flightGroup
+}
+
+type cacheEntry struct {
+	key     string
+	size    int64
+	expires time.Time
+	output  ReceiveAndForwardResponse
+}
+
+// NewResponseCache creates a response cache with the given config
+func NewResponseCache(config CacheConfig) *ResponseCache {
+	return &ResponseCache{
+		config:  config,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Cacheable reports whether responses for the target may be cached
+func (c *ResponseCache) Cacheable(target string) bool {
+	if c.config.MaxBytes <= 0 {
+		return false
+	}
+	_, ok := c.config.TargetTTL[target]
+	return ok
+}
+
+// Key builds the cache key from every input changing the forwarded request:
+// target, canonicalised task, content type, the beta flag and the selected
+// headers. The request id and X-Forwarded-For differ per request and are
+// left out.
+func (c *ResponseCache) Key(request ReceiveAndForwardRequest) (string, error) {
+	task := request.Body.RawTask
+	if task == nil {
+		var err error
+		if task, err = canonicalJSON(request.Body.Task); err != nil {
+			return "", err
+		}
+	}
+
+	h := sha256.New()
+	h.Write([]byte(request.Body.TargetURL))
+	h.Write([]byte{0})
+	h.Write(task)
+	h.Write([]byte{0})
+	contentType := request.ContentType
+	if request.Body.TaskContentType != "" {
+		contentType = request.Body.TaskContentType
+	}
+	h.Write([]byte(contentType))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatBool(request.QueryString.IsBeta)))
+	for _, name := range c.config.KeyHeaders {
+		h.Write([]byte{0})
+		h.Write([]byte(http.CanonicalHeaderKey(name)))
+		h.Write([]byte{':'})
+		h.Write([]byte(headerValue(request.Headers, name)))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get returns the unexpired response stored for key
+func (c *ResponseCache) Get(key string) (ReceiveAndForwardResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return ReceiveAndForwardResponse{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return ReceiveAndForwardResponse{}, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.output, true
+}
+
+// Set stores output under key for ttl, evicting least recently used entries
+// until the cache fits in its byte budget.
+func (c *ResponseCache) Set(key string, output ReceiveAndForwardResponse, ttl time.Duration) {
+	size := responseSize(key, output)
+	if ttl <= 0 || size > c.config.MaxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	entry := &cacheEntry{
+		key:     key,
+		size:    size,
+		expires: time.Now().Add(ttl),
+		output:  output,
+	}
+	c.entries[key] = c.ll.PushFront(entry)
+	c.size += size
+
+	for c.size > c.config.MaxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *ResponseCache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// TTL works out how long output may be cached for target, honouring upstream
+// Cache-Control and Expires before falling back to the target default.
+func (c *ResponseCache) TTL(target string, output ReceiveAndForwardResponse) time.Duration {
+	header := output.UpstreamHeader
+
+	// every Cache-Control line is scanned, a forbidding directive wins over
+	// max-age wherever it appears, and s-maxage over max-age as in a shared cache
+	maxAge, sMaxAge := -1, -1
+	for _, cc := range header["Cache-Control"] {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-store", directive == "no-cache", directive == "private":
+				return 0
+			case strings.HasPrefix(directive, "s-maxage="), strings.HasPrefix(directive, "max-age="):
+				seconds, err := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+				if err != nil || seconds < 0 {
+					return 0
+				}
+				if strings.HasPrefix(directive, "s-maxage=") {
+					sMaxAge = seconds
+				} else {
+					maxAge = seconds
+				}
+			}
+		}
+	}
+	switch {
+	case sMaxAge >= 0:
+		return time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return time.Until(t)
+	}
+
+	return c.config.TargetTTL[target]
+}
+
+type cachingMiddleware struct {
+	cache *ResponseCache
+	next  Service
+}
+
+func (cmw *cachingMiddleware) ReceiveAndForward(ctx context.Context, request ReceiveAndForwardRequest) (ReceiveAndForwardResponse, error) {
+	if !cmw.cache.Cacheable(request.Body.TargetURL) {
+		return cmw.next.ReceiveAndForward(ctx, request)
+	}
+
+	key, err := cmw.cache.Key(request)
+	if err != nil {
+		return cmw.next.ReceiveAndForward(ctx, request)
+	}
+
+	if output, ok := cmw.cache.Get(key); ok {
+		output.CacheStatus = CacheHit
+		return output, nil
+	}
+
+	// Concurrent identical misses share a single upstream call.
+	output, err := cmw.cache.flights.Do(ctx, key, func() (ReceiveAndForwardResponse, error) {
+		output, err := cmw.next.ReceiveAndForward(ctx, request)
+		if err == nil && output.Status == http.StatusOK {
+			cmw.cache.Set(key, output, cmw.cache.TTL(request.Body.TargetURL, output))
+		}
+		return output, err
+	})
+	output.CacheStatus = CacheMiss
+	return output, err
+}
+
+func (cmw *cachingMiddleware) HealthCheck(ctx context.Context, request HealthCheckRequest) (HealthCheckResponse, error) {
+	return cmw.next.HealthCheck(ctx, request)
+}
+
+func (cmw *cachingMiddleware) Version(ctx context.Context) (VersionResponse, error) {
+	return cmw.next.Version(ctx)
+}
+
+// flightGroup suppresses duplicate in-flight calls for the same key.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg     sync.WaitGroup
+	output ReceiveAndForwardResponse
+	err    error
+	// abandoned is set when the context of the caller running fn was done,
+	// its outcome is then not shared
+	abandoned bool
+}
+
+// Do runs fn, the call of the request whose context is ctx, once for
+// concurrent callers of the same key. Waiting callers share its outcome,
+// unless the caller running it went away: they then call again.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func() (ReceiveAndForwardResponse, error)) (ReceiveAndForwardResponse, error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flightCall)
+		}
+		if call, ok := g.calls[key]; ok {
+			g.mu.Unlock()
+			call.wg.Wait()
+			if call.abandoned && ctx.Err() == nil {
+				continue
+			}
+			return call.output, call.err
+		}
+		call := new(flightCall)
+		call.wg.Add(1)
+		g.calls[key] = call
+		g.mu.Unlock()
+
+		call.output, call.err = fn()
+		call.abandoned = ctx.Err() != nil
+
+		// removed first, so that callers calling again do not find it
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+
+		return call.output, call.err
+	}
+}
+
+// canonicalJSON re-encodes the task so that key order and whitespace do not
+// affect the cache key.
+func canonicalJSON(raw *json.RawMessage) ([]byte, error) {
+	if raw == nil {
+		return []byte("null"), nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(*raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func headerValue(h Headers, name string) string {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization":
+		return h.Authorization
+	case "X-Request-Id":
+		return h.RequestID
+	case "Content-Type":
+		return h.ContentType
+	case "X-Forwarded-For":
+		return h.XForwardedFor
+	}
+	return ""
+}
+
+func responseSize(key string, output ReceiveAndForwardResponse) int64 {
+	size := int64(len(key) + len(output.Reason))
+	if output.Message != nil {
+		size += int64(len(*output.Message))
+	}
+	for k, values := range output.UpstreamHeader {
+		size += int64(len(k))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
@@ -0,0 +1,257 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cacheRequest(target, task string) ReceiveAndForwardRequest {
+	raw := json.RawMessage(task)
+	return ReceiveAndForwardRequest{
+		Headers: Headers{ContentType: "application/json", RequestID: "id-1"},
+		Body:    Body{TargetURL: target, Task: &raw},
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	cache := NewResponseCache(CacheConfig{MaxBytes: 1 << 20, KeyHeaders: []string{"authorization"}})
+	base := cacheRequest("worker-1", `{"a":1,"b":2}`)
+
+	tests := []struct {
+		name   string
+		change func(r *ReceiveAndForwardRequest)
+		same   bool
+	}{
+		{"identical", func(r *ReceiveAndForwardRequest) {}, true},
+		{"key order and whitespace", func(r *ReceiveAndForwardRequest) {
+			raw := json.RawMessage(`{ "b": 2, "a": 1 }`)
+			r.Body.Task = &raw
+		}, true},
+		{"request id", func(r *ReceiveAndForwardRequest) { r.RequestID = "id-2" }, true},
+		{"x-forwarded-for", func(r *ReceiveAndForwardRequest) { r.XForwardedFor = "10.0.0.1" }, true},
+		{"target", func(r *ReceiveAndForwardRequest) { r.Body.TargetURL = "worker-2" }, false},
+		{"task", func(r *ReceiveAndForwardRequest) {
+			raw := json.RawMessage(`{"a":1,"b":3}`)
+			r.Body.Task = &raw
+		}, false},
+		{"beta", func(r *ReceiveAndForwardRequest) { r.IsBeta = true }, false},
+		{"content type", func(r *ReceiveAndForwardRequest) { r.ContentType = "application/cbor" }, false},
+		{"task content type", func(r *ReceiveAndForwardRequest) { r.Body.TaskContentType = "text/plain" }, false},
+		{"key header", func(r *ReceiveAndForwardRequest) { r.Authorization = "Bearer x" }, false},
+		{"raw task", func(r *ReceiveAndForwardRequest) { r.Body.RawTask = []byte{0x01} }, false},
+	}
+
+	want, err := cache.Key(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := base
+			tt.change(&r)
+			got, err := cache.Key(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.same {
+				t.Errorf("same key = %v, want %v", got == want, tt.same)
+			}
+		})
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	cache := NewResponseCache(CacheConfig{MaxBytes: 1 << 20, TargetTTL: map[string]time.Duration{"worker-1": time.Minute}})
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"target default", nil, time.Minute},
+		{"max-age", http.Header{"Cache-Control": {"max-age=30"}}, 30 * time.Second},
+		{"s-maxage wins", http.Header{"Cache-Control": {"s-maxage=10, max-age=30"}}, 10 * time.Second},
+		{"s-maxage on a later line", http.Header{"Cache-Control": {"max-age=30", "s-maxage=10"}}, 10 * time.Second},
+		{"no-store after max-age", http.Header{"Cache-Control": {"max-age=30, no-store"}}, 0},
+		{"no-cache on a later line", http.Header{"Cache-Control": {"max-age=30", "no-cache"}}, 0},
+		{"private", http.Header{"Cache-Control": {"Private"}}, 0},
+		{"invalid max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 0},
+		{"negative max-age", http.Header{"Cache-Control": {"max-age=-1"}}, 0},
+		{"zero max-age", http.Header{"Cache-Control": {"max-age=0"}}, 0},
+		{"other directives", http.Header{"Cache-Control": {"public"}}, time.Minute},
+		{"invalid expires", http.Header{"Expires": {"soon"}}, 0},
+		{"expired", http.Header{"Expires": {"Thu, 01 Jan 1970 00:00:00 GMT"}}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cache.TTL("worker-1", ReceiveAndForwardResponse{UpstreamHeader: tt.header})
+			if tt.want < 0 {
+				if got >= 0 {
+					t.Errorf("TTL = %v, want negative", got)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("TTL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	expires := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	got := cache.TTL("worker-1", ReceiveAndForwardResponse{UpstreamHeader: http.Header{"Expires": {expires}}})
+	if got <= 58*time.Minute || got > time.Hour {
+		t.Errorf("TTL of Expires in an hour = %v", got)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	message := json.RawMessage(`"0123456789"`)
+	output := ReceiveAndForwardResponse{Status: http.StatusOK, Message: &message}
+	size := responseSize("a", output)
+	cache := NewResponseCache(CacheConfig{MaxBytes: 2 * size})
+
+	cache.Set("a", output, time.Minute)
+	cache.Set("b", output, time.Minute)
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("a missing")
+	}
+	cache.Set("c", output, time.Minute)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.Get(key); ok != want {
+			t.Errorf("Get(%s) found = %v, want %v", key, ok, want)
+		}
+	}
+
+	cache.Set("d", output, 0)
+	if _, ok := cache.Get("d"); ok {
+		t.Error("entry without TTL cached")
+	}
+	cache.Set("e", output, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := cache.Get("e"); ok {
+		t.Error("expired entry returned")
+	}
+}
+
+type countingService struct {
+	Service
+	calls int32
+	fn    func(ctx context.Context) (ReceiveAndForwardResponse, error)
+}
+
+func (s *countingService) ReceiveAndForward(ctx context.Context, request ReceiveAndForwardRequest) (ReceiveAndForwardResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return s.fn(ctx)
+}
+
+func TestCachingMiddleware(t *testing.T) {
+	message := json.RawMessage(`{"ok":true}`)
+	next := &countingService{fn: func(context.Context) (ReceiveAndForwardResponse, error) {
+		return ReceiveAndForwardResponse{Status: http.StatusOK, Message: &message}, nil
+	}}
+	cache := NewResponseCache(CacheConfig{MaxBytes: 1 << 20, TargetTTL: map[string]time.Duration{"worker-1": time.Minute}})
+	svc := ServiceCachingMiddleware(cache)(next)
+
+	tests := []struct {
+		target string
+		want   string
+		calls  int32
+	}{
+		{"worker-1", CacheMiss, 1},
+		{"worker-1", CacheHit, 1},
+		{"worker-2", "", 2},
+		{"worker-2", "", 3},
+	}
+	for i, tt := range tests {
+		output, err := svc.ReceiveAndForward(context.Background(), cacheRequest(tt.target, `{"a":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.CacheStatus != tt.want || atomic.LoadInt32(&next.calls) != tt.calls {
+			t.Errorf("request %d: cache status %q and %d calls, want %q and %d", i, output.CacheStatus, next.calls, tt.want, tt.calls)
+		}
+	}
+}
+
+func TestFlightGroupSharesCall(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	fn := func() (ReceiveAndForwardResponse, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return ReceiveAndForwardResponse{Status: http.StatusOK}, nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.Do(context.Background(), "key", fn)
+	}()
+	<-started
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output, err := g.Do(context.Background(), "key", fn)
+			if err != nil || output.Status != http.StatusOK {
+				t.Errorf("shared outcome %d, %v", output.Status, err)
+			}
+		}()
+	}
+	// let the callers reach the call in flight
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("%d calls, want 1", calls)
+	}
+}
+
+func TestFlightGroupLeaderCanceled(t *testing.T) {
+	var g flightGroup
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+
+	done := make(chan error)
+	go func() {
+		_, err := g.Do(leaderCtx, "key", func() (ReceiveAndForwardResponse, error) {
+			close(started)
+			<-leaderCtx.Done()
+			return ReceiveAndForwardResponse{}, leaderCtx.Err()
+		})
+		done <- err
+	}()
+	<-started
+
+	followerDone := make(chan ReceiveAndForwardResponse)
+	go func() {
+		output, err := g.Do(context.Background(), "key", func() (ReceiveAndForwardResponse, error) {
+			return ReceiveAndForwardResponse{Status: http.StatusOK}, nil
+		})
+		if err != nil {
+			t.Errorf("follower got %v", err)
+		}
+		followerDone <- output
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("leader got %v, want %v", err, context.Canceled)
+	}
+	if output := <-followerDone; output.Status != http.StatusOK {
+		t.Errorf("follower status %d, want %d", output.Status, http.StatusOK)
+	}
+}
@@ -0,0 +1,271 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// MetricsEndpoint serves the certificate metrics on the monitoring listener,
+// in the Prometheus text format
+const MetricsEndpoint = "/metrics"
+
+// DefaultCertWarnDays are the days before expiry at which certificate
+// warnings are logged
+var DefaultCertWarnDays = []int{30, 14, 7, 1}
+
+const day = 24 * time.Hour
+
+// CertMonitorConfig holds the expiry thresholds of the certificate monitor
+type CertMonitorConfig struct {
+	// Certificates are the server certificate chain and the CAs loaded at startup.
+	Certificates []CertificateInfo
+	// WarnDays are the days before expiry at which a warning is logged, once
+	// per certificate and threshold. The largest also makes readiness warn.
+	WarnDays []int
+	// ReadyDays fails readiness once a loaded certificate expires within as
+	// many days. Zero fails readiness on expiry only.
+	ReadyDays int
+	// Interval is how often the thresholds are checked.
+	Interval time.Duration
+}
+
+// CertificateStatus adds the time left to a CertificateInfo
+type CertificateStatus struct {
+	CertificateInfo
+	DaysLeft int  `json:"days_left"`
+	Expired  bool `json:"expired"`
+	// Status is ok, warn or fail, as in the readiness checks.
+	Status string `json:"status"`
+}
+
+// CertMonitor watches the expiry of the certificates loaded at startup and of
+// those presented by upstream targets. Upstream certificates are renewed by
+// their owners, so they warn but never fail readiness.
+type CertMonitor struct {
+	config CertMonitorConfig
+	logger log.Logger
+
+	mu sync.Mutex
+	// upstream holds the chain last presented per target
+	upstream map[string][]CertificateInfo
+	// logged holds the lowest threshold logged per certificate, 0 once expired
+	logged map[string]int
+}
+
+// NewCertMonitor returns a monitor of the certificates of config
+func NewCertMonitor(config CertMonitorConfig, logger log.Logger) *CertMonitor {
+	warnDays := append([]int(nil), config.WarnDays...)
+	sort.Sort(sort.Reverse(sort.IntSlice(warnDays)))
+	config.WarnDays = warnDays
+	if config.Interval <= 0 {
+		config.Interval = time.Hour
+	}
+	return &CertMonitor{
+		config:   config,
+		logger:   logger,
+		upstream: make(map[string][]CertificateInfo),
+		logged:   make(map[string]int),
+	}
+}
+
+// ParseCertWarnDays parses the warning thresholds, positive numbers of days
+func ParseCertWarnDays(items []string) ([]int, error) {
+	days := make([]int, 0, len(items))
+	for _, item := range items {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid number of days %q", item)
+		}
+		days = append(days, n)
+	}
+	return days, nil
+}
+
+// ObserveUpstream records the certificates presented by an upstream target.
+// It is the VerifyConnection hook of the upstream TLS configs and never
+// fails the handshake.
+func (m *CertMonitor) ObserveUpstream(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	// the server name is not sent for IP addresses
+	target := cs.ServerName
+	if target == "" {
+		target = certIdentity(cs.PeerCertificates[0])
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous := m.upstream[target]
+	if len(previous) == len(cs.PeerCertificates) && previous[0].Serial == cs.PeerCertificates[0].SerialNumber.String() {
+		return nil
+	}
+	chain := make([]CertificateInfo, 0, len(cs.PeerCertificates))
+	for _, cert := range cs.PeerCertificates {
+		info := certificateInfo(CertRoleUpstream, cert)
+		info.Target = target
+		chain = append(chain, info)
+	}
+	m.upstream[target] = chain
+	m.checkLocked(chain, time.Now())
+	return nil
+}
+
+// Certificates returns the status of the loaded certificates, followed by
+// those presented by upstream sorted by target
+func (m *CertMonitor) Certificates() []CertificateStatus {
+	now := time.Now()
+	certs := m.certificates()
+	statuses := make([]CertificateStatus, 0, len(certs))
+	for _, cert := range certs {
+		statuses = append(statuses, m.status(cert, now))
+	}
+	return statuses
+}
+
+func (m *CertMonitor) certificates() []CertificateInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	targets := make([]string, 0, len(m.upstream))
+	for target := range m.upstream {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	certs := append([]CertificateInfo(nil), m.config.Certificates...)
+	for _, target := range targets {
+		certs = append(certs, m.upstream[target]...)
+	}
+	return certs
+}
+
+func (m *CertMonitor) status(cert CertificateInfo, now time.Time) CertificateStatus {
+	left := cert.NotAfter.Sub(now)
+	s := CertificateStatus{
+		CertificateInfo: cert,
+		DaysLeft:        int(left / day),
+		Expired:         left <= 0,
+		Status:          CheckOK,
+	}
+	switch {
+	case s.Expired, now.Before(cert.NotBefore):
+		s.Status = CheckFail
+	case left < time.Duration(m.config.ReadyDays)*day:
+		s.Status = CheckFail
+	case len(m.config.WarnDays) > 0 && left < time.Duration(m.config.WarnDays[0])*day:
+		s.Status = CheckWarn
+	}
+	if cert.Role == CertRoleUpstream && s.Status == CheckFail {
+		s.Status = CheckWarn
+	}
+	return s
+}
+
+// Run logs the certificates crossing a threshold, at start and then every
+// interval until ctx is done
+func (m *CertMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for {
+		certs := m.certificates()
+		m.mu.Lock()
+		m.checkLocked(certs, time.Now())
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkLocked logs the certificates which crossed a threshold since the last
+// check, expired certificates at error
+func (m *CertMonitor) checkLocked(certs []CertificateInfo, now time.Time) {
+	for _, cert := range certs {
+		left := cert.NotAfter.Sub(now)
+		threshold := -1
+		for _, days := range m.config.WarnDays {
+			if left < time.Duration(days)*day {
+				threshold = days
+			}
+		}
+		if left <= 0 {
+			threshold = 0
+		}
+		key := cert.Role + "|" + cert.File + "|" + cert.Target + "|" + cert.Serial
+		if last, ok := m.logged[key]; threshold < 0 || (ok && last <= threshold) {
+			continue
+		}
+		m.logged[key] = threshold
+
+		keyvals := []interface{}{
+			"role", cert.Role,
+			"subject", cert.Subject,
+			"serial", cert.Serial,
+			"not_after", cert.NotAfter,
+			"days_left", int(left / day),
+		}
+		if cert.File != "" {
+			keyvals = append(keyvals, "file", cert.File)
+		} else {
+			keyvals = append(keyvals, "target", cert.Target)
+		}
+		if threshold == 0 {
+			level.Error(m.logger).Log(append([]interface{}{"msg", "certificate expired"}, keyvals...)...)
+			continue
+		}
+		level.Warn(m.logger).Log(append([]interface{}{"msg", "certificate expires soon", "threshold_days", threshold}, keyvals...)...)
+	}
+}
+
+// MetricsHandler serves the days left per certificate in the Prometheus text
+// format
+func (m *CertMonitor) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes the certificate gauges to w
+func (m *CertMonitor) WriteMetrics(w io.Writer) {
+	now := time.Now()
+	certs := m.certificates()
+	gauge := func(name, help string, value func(CertificateInfo) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, cert := range certs {
+			source := cert.File
+			if source == "" {
+				source = cert.Target
+			}
+			fmt.Fprintf(w, "%s{role=%s,source=%s,subject=%s,serial=%s} %s\n", name,
+				metricLabel(cert.Role), metricLabel(source), metricLabel(cert.Subject), metricLabel(cert.Serial),
+				strconv.FormatFloat(value(cert), 'f', -1, 64))
+		}
+	}
+	gauge("goproxy_certificate_expiry_days", "Days until the certificate expires, negative once expired.", func(cert CertificateInfo) float64 {
+		return cert.NotAfter.Sub(now).Hours() / 24
+	})
+	gauge("goproxy_certificate_not_after_timestamp_seconds", "Expiry of the certificate in seconds since the epoch.", func(cert CertificateInfo) float64 {
+		return float64(cert.NotAfter.Unix())
+	})
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabel(value string) string {
+	return `"` + metricLabelEscaper.Replace(value) + `"`
+}
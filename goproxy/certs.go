@@ -0,0 +1,92 @@
+package goproxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"time"
+)
+
+// Roles of the certificates loaded by the proxy
+const (
+	CertRoleServer = "server"
+	CertRoleCA     = "ca"
+	// CertRoleUpstream certificates are presented by upstream targets
+	CertRoleUpstream = "upstream"
+)
+
+// CertificateInfo describes a certificate loaded by the proxy
+type CertificateInfo struct {
+	Role string `json:"role"`
+	// File is set for loaded certificates, Target for those presented by upstream.
+	File      string    `json:"file,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// LoadedCertificates describes the server certificate chain in serverCert
+// and the CAs in caFiles. Files without certificates, such as keys, are skipped.
+func LoadedCertificates(serverCert string, caFiles []string) ([]CertificateInfo, error) {
+	var infos []CertificateInfo
+	add := func(role, file string) error {
+		certs, err := ReadCertificates(file)
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			info := certificateInfo(role, cert)
+			info.File = file
+			infos = append(infos, info)
+		}
+		return nil
+	}
+
+	if err := add(CertRoleServer, serverCert); err != nil {
+		return nil, err
+	}
+	for _, file := range caFiles {
+		if err := add(CertRoleCA, file); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+func certificateInfo(role string, cert *x509.Certificate) CertificateInfo {
+	return CertificateInfo{
+		Role:      role,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.String(),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+	}
+}
+
+// ReadCertificates returns the PEM encoded certificates in file
+func ReadCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -0,0 +1,209 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v4"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Envelope media types
+const (
+	MediaTypeJSON     = "application/json"
+	MediaTypeMsgpack  = "application/msgpack"
+	MediaTypeCBOR     = "application/cbor"
+	MediaTypeProtobuf = "application/x-protobuf"
+	MediaTypeOctet    = "application/octet-stream"
+)
+
+// EnvelopeCodec decodes the /task envelope, the target and the task, from a
+// request body. Codecs of binary formats keep the task as opaque bytes in
+// Body.RawTask and set Body.TaskContentType to the encoding of those bytes.
+type EnvelopeCodec interface {
+	Decode(data []byte) (Body, error)
+}
+
+var envelopeCodecs = map[string]EnvelopeCodec{
+	MediaTypeJSON:                     jsonEnvelopeCodec{},
+	MediaTypeMsgpack:                  msgpackEnvelopeCodec{},
+	"application/x-msgpack":           msgpackEnvelopeCodec{},
+	MediaTypeCBOR:                     cborEnvelopeCodec{},
+	MediaTypeProtobuf:                 protobufEnvelopeCodec{},
+	"application/protobuf":            protobufEnvelopeCodec{},
+	"application/vnd.google.protobuf": protobufEnvelopeCodec{},
+}
+
+// RegisterEnvelopeCodec makes codec handle requests of mediaType. It must be
+// called before the HTTP handlers are serving.
+func RegisterEnvelopeCodec(mediaType string, codec EnvelopeCodec) {
+	envelopeCodecs[strings.ToLower(mediaType)] = codec
+}
+
+// EnvelopeCodecFor returns the codec registered for a Content-Type header value.
+// Parameters are allowed, but a charset other than utf-8 is not.
+func EnvelopeCodecFor(contentType string) (EnvelopeCodec, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return nil, false
+	}
+	codec, ok := envelopeCodecs[mediaType]
+	return codec, ok
+}
+
+// TaskBytes returns the task as it is forwarded upstream
+func (b Body) TaskBytes() []byte {
+	if b.RawTask != nil {
+		return b.RawTask
+	}
+	if b.Task == nil {
+		return []byte("null")
+	}
+	return *b.Task
+}
+
+var errEnvelopeMissingTask = errors.New("envelope has no task")
+
+type jsonEnvelopeCodec struct{}
+
+func (jsonEnvelopeCodec) Decode(data []byte) (Body, error) {
+	var body Body
+	err := json.Unmarshal(data, &body)
+	return body, err
+}
+
+// msgpackEnvelopeCodec decodes a map of target (string) and task (any value)
+type msgpackEnvelopeCodec struct{}
+
+func (msgpackEnvelopeCodec) Decode(data []byte) (Body, error) {
+	var body Body
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return body, err
+	}
+	for i := 0; i < n; i++ {
+		key, err := dec.DecodeString()
+		if err != nil {
+			return body, err
+		}
+		switch key {
+		case "target":
+			if body.TargetURL, err = dec.DecodeString(); err != nil {
+				return body, err
+			}
+		case "task":
+			// bytes.Reader is not buffered by the decoder, so offsets delimit the raw value
+			start := len(data) - r.Len()
+			if err := dec.Skip(); err != nil {
+				return body, err
+			}
+			body.RawTask = data[start : len(data)-r.Len()]
+		default:
+			if err := dec.Skip(); err != nil {
+				return body, err
+			}
+		}
+	}
+
+	if body.RawTask == nil {
+		return body, errEnvelopeMissingTask
+	}
+	body.TaskContentType = MediaTypeMsgpack
+	return body, nil
+}
+
+// cborEnvelopeCodec decodes a map of target (text) and task (any item)
+type cborEnvelopeCodec struct{}
+
+func (cborEnvelopeCodec) Decode(data []byte) (Body, error) {
+	var envelope struct {
+		Target string          `cbor:"target"`
+		Task   cbor.RawMessage `cbor:"task"`
+	}
+	if err := cbor.Unmarshal(data, &envelope); err != nil {
+		return Body{}, err
+	}
+	if envelope.Task == nil {
+		return Body{}, errEnvelopeMissingTask
+	}
+	return Body{
+		TargetURL:       envelope.Target,
+		RawTask:         []byte(envelope.Task),
+		TaskContentType: MediaTypeCBOR,
+	}, nil
+}
+
+// protobufEnvelopeCodec decodes the message
+//
+//	message Envelope {
+//	  string target = 1;
+//	  bytes task = 2;
+//	  string task_content_type = 3;
+//	}
+//
+// The task bytes are opaque and forwarded with task_content_type, or
+// application/octet-stream when it is not set.
+type protobufEnvelopeCodec struct{}
+
+func (protobufEnvelopeCodec) Decode(data []byte) (Body, error) {
+	var body Body
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return body, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return body, protowire.ParseError(n)
+			}
+			body.TargetURL = v
+			data = data[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return body, protowire.ParseError(n)
+			}
+			body.RawTask = append([]byte{}, v...)
+			data = data[n:]
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return body, protowire.ParseError(n)
+			}
+			body.TaskContentType = v
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return body, protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+
+	if body.RawTask == nil {
+		body.RawTask = []byte{}
+	}
+	if body.TaskContentType == "" {
+		body.TaskContentType = MediaTypeOctet
+	}
+	if _, _, err := mime.ParseMediaType(body.TaskContentType); err != nil {
+		return body, fmt.Errorf("invalid task content type %q: %v", body.TaskContentType, err)
+	}
+	return body, nil
+}
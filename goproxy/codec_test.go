@@ -0,0 +1,182 @@
+package goproxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v4"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestEnvelopeCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        EnvelopeCodec
+	}{
+		{"application/json", jsonEnvelopeCodec{}},
+		{"application/json; charset=utf-8", jsonEnvelopeCodec{}},
+		{"Application/JSON; charset=UTF-8", jsonEnvelopeCodec{}},
+		{"application/msgpack", msgpackEnvelopeCodec{}},
+		{"application/x-msgpack", msgpackEnvelopeCodec{}},
+		{"application/cbor", cborEnvelopeCodec{}},
+		{"application/x-protobuf", protobufEnvelopeCodec{}},
+		{"application/protobuf", protobufEnvelopeCodec{}},
+		{"application/json; charset=latin1", nil},
+		{"text/plain", nil},
+		{"", nil},
+		{"application/", nil},
+	}
+	for _, tt := range tests {
+		got, ok := EnvelopeCodecFor(tt.contentType)
+		if ok != (tt.want != nil) || got != tt.want {
+			t.Errorf("EnvelopeCodecFor(%q) = %T, %v, want %T", tt.contentType, got, ok, tt.want)
+		}
+	}
+}
+
+func protobufEnvelope(target string, task []byte, contentType string) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, target)
+	if task != nil {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, task)
+	}
+	// unknown fields are skipped
+	b = protowire.AppendTag(b, 9, protowire.VarintType)
+	b = protowire.AppendVarint(b, 42)
+	if contentType != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, contentType)
+	}
+	return b
+}
+
+func mustMarshal(t *testing.T, marshal func(interface{}) ([]byte, error), v interface{}) []byte {
+	t.Helper()
+	data, err := marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEnvelopeCodecRoundTrip(t *testing.T) {
+	task := map[string]interface{}{"id": "42", "values": []interface{}{"a", "b"}}
+	tests := []struct {
+		name        string
+		codec       EnvelopeCodec
+		data        []byte
+		target      string
+		contentType string
+		// decode turns the raw task back into a value, nil compares the bytes
+		decode func([]byte) (interface{}, error)
+		task   []byte
+		err    bool
+	}{
+		{
+			name:        "msgpack",
+			codec:       msgpackEnvelopeCodec{},
+			data:        mustMarshal(t, msgpack.Marshal, map[string]interface{}{"extra": 1, "target": "worker-1", "task": task}),
+			target:      "worker-1",
+			contentType: MediaTypeMsgpack,
+			decode: func(b []byte) (interface{}, error) {
+				var v map[string]interface{}
+				return v, msgpack.Unmarshal(b, &v)
+			},
+		},
+		{
+			name:  "msgpack without task",
+			codec: msgpackEnvelopeCodec{},
+			data:  mustMarshal(t, msgpack.Marshal, map[string]interface{}{"target": "worker-1"}),
+			err:   true,
+		},
+		{
+			name:  "msgpack truncated",
+			codec: msgpackEnvelopeCodec{},
+			data:  mustMarshal(t, msgpack.Marshal, map[string]interface{}{"target": "worker-1", "task": task})[:10],
+			err:   true,
+		},
+		{
+			name:        "cbor",
+			codec:       cborEnvelopeCodec{},
+			data:        mustMarshal(t, cbor.Marshal, map[string]interface{}{"target": "worker-1", "task": task}),
+			target:      "worker-1",
+			contentType: MediaTypeCBOR,
+			decode: func(b []byte) (interface{}, error) {
+				var v map[string]interface{}
+				return v, cbor.Unmarshal(b, &v)
+			},
+		},
+		{
+			name:  "cbor without task",
+			codec: cborEnvelopeCodec{},
+			data:  mustMarshal(t, cbor.Marshal, map[string]interface{}{"target": "worker-1"}),
+			err:   true,
+		},
+		{
+			name:        "protobuf",
+			codec:       protobufEnvelopeCodec{},
+			data:        protobufEnvelope("worker-1", []byte{0x00, 0xff, 0x10}, "application/vnd.test"),
+			target:      "worker-1",
+			contentType: "application/vnd.test",
+			task:        []byte{0x00, 0xff, 0x10},
+		},
+		{
+			name:        "protobuf defaults",
+			codec:       protobufEnvelopeCodec{},
+			data:        protobufEnvelope("worker-1", nil, ""),
+			target:      "worker-1",
+			contentType: MediaTypeOctet,
+			task:        []byte{},
+		},
+		{
+			name:  "protobuf invalid content type",
+			codec: protobufEnvelopeCodec{},
+			data:  protobufEnvelope("worker-1", []byte{1}, "not a type"),
+			err:   true,
+		},
+		{
+			name:  "protobuf truncated",
+			codec: protobufEnvelopeCodec{},
+			data:  protobufEnvelope("worker-1", []byte{1, 2, 3}, "")[:5],
+			err:   true,
+		},
+		{
+			name:   "json",
+			codec:  jsonEnvelopeCodec{},
+			data:   []byte(`{"target":"worker-1","task":{"id":"42"}}`),
+			target: "worker-1",
+			task:   []byte(`{"id":"42"}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := tt.codec.Decode(tt.data)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if body.TargetURL != tt.target || body.TaskContentType != tt.contentType {
+				t.Errorf("target %q content type %q, want %q %q", body.TargetURL, body.TaskContentType, tt.target, tt.contentType)
+			}
+			if tt.decode == nil {
+				if !bytes.Equal(body.TaskBytes(), tt.task) {
+					t.Errorf("task %x, want %x", body.TaskBytes(), tt.task)
+				}
+				return
+			}
+			got, err := tt.decode(body.TaskBytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, task) {
+				t.Errorf("task %#v, want %#v", got, task)
+			}
+		})
+	}
+}
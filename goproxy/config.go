@@ -0,0 +1,846 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the schema of the configuration file, in YAML (.yaml, .yml) or
+// TOML (.toml). Every setting corresponds to the command line flag named by
+// its flag tag, flags and environment variables take precedence over the
+// file. Settings left out keep the flag default.
+type Config struct {
+	Listeners       ConfigListeners `yaml:"listeners" toml:"listeners"`
+	TLS             ConfigTLS       `yaml:"tls" toml:"tls"`
+	Upstream        ConfigUpstream  `yaml:"upstream" toml:"upstream"`
+	Logging         ConfigLogging   `yaml:"logging" toml:"logging"`
+	AccessLog       ConfigAccessLog `yaml:"access_log" toml:"access_log"`
+	Audit           ConfigAudit     `yaml:"audit" toml:"audit"`
+	Cache           ConfigCache     `yaml:"cache" toml:"cache"`
+	Redact          ConfigRedact    `yaml:"redact" toml:"redact"`
+	Tracing         ConfigTracing   `yaml:"tracing" toml:"tracing"`
+	Stream          ConfigStream    `yaml:"stream" toml:"stream"`
+	Admin           ConfigAdmin     `yaml:"admin" toml:"admin"`
+	Readiness       ConfigReadiness `yaml:"readiness" toml:"readiness"`
+	Shutdown        ConfigShutdown  `yaml:"shutdown" toml:"shutdown"`
+	RequestIDPrefix *string         `yaml:"request_id_prefix" toml:"request_id_prefix" flag:"request-id-prefix"`
+}
+
+// Duration is a duration such as 30s or 24h
+type Duration string
+
+// ConfigListeners holds the listener settings
+type ConfigListeners struct {
+	TLSPort             *string  `yaml:"tls_port" toml:"tls_port" flag:"tls-port"`
+	MonitoringPort      *string  `yaml:"monitoring_port" toml:"monitoring_port" flag:"monitoring-port"`
+	GRPCPort            *string  `yaml:"grpc_port" toml:"grpc_port" flag:"grpc-port"`
+	Task                []string `yaml:"task" toml:"task" flag:"task-listen"`
+	Monitoring          []string `yaml:"monitoring" toml:"monitoring" flag:"monitoring-listen"`
+	MonitoringPlaintext *bool    `yaml:"monitoring_plaintext" toml:"monitoring_plaintext" flag:"monitoring-plaintext"`
+	SocketMode          *string  `yaml:"socket_mode" toml:"socket_mode" flag:"socket-mode"`
+}
+
+// ConfigTLS holds the certificates of the listeners
+type ConfigTLS struct {
+	ServerCert *string          `yaml:"server_cert" toml:"server_cert" flag:"server-cert-path"`
+	ServerKey  *string          `yaml:"server_key" toml:"server_key" flag:"server-key-path"`
+	CACertsDir *string          `yaml:"ca_certs_dir" toml:"ca_certs_dir" flag:"ca-certs-dir"`
+	Expiry     ConfigCertExpiry `yaml:"expiry" toml:"expiry"`
+}
+
+// ConfigCertExpiry holds the thresholds of the certificate expiry monitoring
+type ConfigCertExpiry struct {
+	WarnDays      []string  `yaml:"warn_days" toml:"warn_days" flag:"cert-warn-days"`
+	ReadyDays     *int      `yaml:"ready_days" toml:"ready_days" flag:"cert-ready-days"`
+	CheckInterval *Duration `yaml:"check_interval" toml:"check_interval" flag:"cert-check-interval"`
+}
+
+// ConfigUpstream holds the upstream port and the per target settings
+type ConfigUpstream struct {
+	Port    *string        `yaml:"port" toml:"port" flag:"upstream-port"`
+	Targets []ConfigTarget `yaml:"targets" toml:"targets"`
+}
+
+// ConfigTarget holds the settings of one target
+type ConfigTarget struct {
+	Name string `yaml:"name" toml:"name"`
+	// Protocol is http1, h2, h2c or grpc:/package.Service/Method.
+	Protocol string            `yaml:"protocol" toml:"protocol"`
+	Timeout  Duration          `yaml:"timeout" toml:"timeout"`
+	CacheTTL Duration          `yaml:"cache_ttl" toml:"cache_ttl"`
+	Headers  map[string]string `yaml:"headers" toml:"headers"`
+}
+
+// ConfigLogging holds the log settings
+type ConfigLogging struct {
+	Level          *string           `yaml:"level" toml:"level" flag:"log-level"`
+	Outputs        []string          `yaml:"outputs" toml:"outputs" flag:"log-output"`
+	OutputLevels   map[string]string `yaml:"output_levels" toml:"output_levels" flag:"log-output-levels"`
+	Directory      *string           `yaml:"directory" toml:"directory" flag:"logdir"`
+	ConnAddr       *string           `yaml:"conn_addr" toml:"conn_addr" flag:"log-conn-addr"`
+	MaxPayload     *int              `yaml:"max_payload" toml:"max_payload" flag:"log-max-payload"`
+	MaxBytes       *int64            `yaml:"max_bytes" toml:"max_bytes" flag:"log-max-bytes"`
+	RotateInterval *Duration         `yaml:"rotate_interval" toml:"rotate_interval" flag:"log-rotate-interval"`
+	MaxBackups     *int              `yaml:"max_backups" toml:"max_backups" flag:"log-max-backups"`
+	MaxAge         *Duration         `yaml:"max_age" toml:"max_age" flag:"log-max-age"`
+	Compress       *bool             `yaml:"compress" toml:"compress" flag:"log-compress"`
+	Syslog         ConfigSyslog      `yaml:"syslog" toml:"syslog"`
+}
+
+// ConfigSyslog holds the settings of the syslog output
+type ConfigSyslog struct {
+	Network   *string `yaml:"network" toml:"network" flag:"syslog-network"`
+	Format    *string `yaml:"format" toml:"format" flag:"syslog-format"`
+	Facility  *string `yaml:"facility" toml:"facility" flag:"syslog-facility"`
+	QueueSize *int    `yaml:"queue_size" toml:"queue_size" flag:"syslog-queue-size"`
+	CAFile    *string `yaml:"ca_file" toml:"ca_file" flag:"syslog-ca-file"`
+}
+
+// ConfigAccessLog holds the access log settings
+type ConfigAccessLog struct {
+	Path   *string `yaml:"path" toml:"path" flag:"access-log"`
+	Format *string `yaml:"format" toml:"format" flag:"access-log-format"`
+}
+
+// ConfigAudit holds the audit log settings
+type ConfigAudit struct {
+	Path        *string `yaml:"path" toml:"path" flag:"audit-log"`
+	MaxBytes    *int64  `yaml:"max_bytes" toml:"max_bytes" flag:"audit-max-bytes"`
+	MaxBackups  *int    `yaml:"max_backups" toml:"max_backups" flag:"audit-max-backups"`
+	IncludeBody *bool   `yaml:"include_body" toml:"include_body" flag:"audit-include-body"`
+	HashChain   *bool   `yaml:"hash_chain" toml:"hash_chain" flag:"audit-hash-chain"`
+}
+
+// ConfigCache holds the response cache settings, the TTLs are set per target
+type ConfigCache struct {
+	MaxBytes   *int64   `yaml:"max_bytes" toml:"max_bytes" flag:"cache-max-bytes"`
+	KeyHeaders []string `yaml:"key_headers" toml:"key_headers" flag:"cache-key-headers"`
+}
+
+// ConfigRedact holds the log redaction settings
+type ConfigRedact struct {
+	Paths    []string    `yaml:"paths" toml:"paths" flag:"redact-paths"`
+	Patterns PatternList `yaml:"patterns" toml:"patterns" flag:"redact-patterns"`
+	Headers  []string    `yaml:"headers" toml:"headers" flag:"redact-headers"`
+}
+
+// PatternList is a list of regular expressions. Patterns may contain commas,
+// so the list is repeated on the command line and newline separated as a
+// single flag value.
+type PatternList []string
+
+// ConfigTracing holds the tracing settings
+type ConfigTracing struct {
+	OTLPEndpoint *string `yaml:"otlp_endpoint" toml:"otlp_endpoint" flag:"otlp-endpoint"`
+}
+
+// ConfigStream holds the /task/stream settings
+type ConfigStream struct {
+	IdleTimeout     *Duration `yaml:"idle_timeout" toml:"idle_timeout" flag:"stream-idle-timeout"`
+	MaxMessageBytes *int64    `yaml:"max_message_bytes" toml:"max_message_bytes" flag:"stream-max-message-bytes"`
+}
+
+// ConfigAdmin holds the admin API settings
+type ConfigAdmin struct {
+	Token *string `yaml:"token" toml:"token" flag:"admin-token"`
+}
+
+// ConfigReadiness holds the checks of /readyz
+type ConfigReadiness struct {
+	Targets     []string `yaml:"targets" toml:"targets" flag:"ready-targets"`
+	MaxInFlight *int     `yaml:"max_in_flight" toml:"max_in_flight" flag:"ready-max-in-flight"`
+}
+
+// ConfigShutdown holds the shutdown and upgrade timeouts
+type ConfigShutdown struct {
+	Timeout        *Duration `yaml:"timeout" toml:"timeout" flag:"shutdown-timeout"`
+	UpgradeTimeout *Duration `yaml:"upgrade_timeout" toml:"upgrade_timeout" flag:"upgrade-timeout"`
+}
+
+// ConfigError lists every problem found in a configuration file, or in the
+// configuration set by flags when Path is empty
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+	}
+	return fmt.Sprintf("invalid configuration file %s:\n  %s", e.Path, strings.Join(e.Problems, "\n  "))
+}
+
+// LoadConfig reads and validates the configuration file at path. Unknown
+// keys, invalid values and unreadable files or certificates are all reported
+// in a single *ConfigError. Files with another extension are read in the
+// deprecated flat format, see LegacyConfigFile.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	var problems []string
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			terr, ok := err.(*yaml.TypeError)
+			if !ok {
+				return nil, &ConfigError{Path: path, Problems: []string{err.Error()}}
+			}
+			// the remaining keys are decoded, so they are checked as well
+			problems = append(problems, terr.Errors...)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), config)
+		if err != nil {
+			return nil, &ConfigError{Path: path, Problems: []string{err.Error()}}
+		}
+		for _, key := range md.Undecoded() {
+			problems = append(problems, fmt.Sprintf("%s: unknown key", key))
+		}
+	default:
+		return loadLegacyConfig(path, data)
+	}
+
+	problems = append(problems, config.problems()...)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Path: path, Problems: problems}
+	}
+	return config, nil
+}
+
+// LegacyConfigFile reports whether the file at path is read in the flat
+// format of earlier releases, one "flag value" pair per line. The format is
+// deprecated in favour of YAML and TOML.
+func LegacyConfigFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".toml":
+		return false
+	}
+	return true
+}
+
+// loadLegacyConfig reads the flat format of earlier releases. Blank lines and
+// lines starting with # are skipped, a flag without value is set to true and
+// a value is cut at " #".
+func loadLegacyConfig(path string, data []byte) (*Config, error) {
+	known := map[string]bool{}
+	repeated := map[string]bool{}
+	visitConfigFields(reflect.ValueOf(&Config{}).Elem(), "", func(key, flag string, v reflect.Value) {
+		known[flag] = true
+		_, repeated[flag] = v.Interface().(PatternList)
+	})
+	for _, flag := range []string{"upstream-protocols", "upstream-timeouts", "cache-targets", "upstream-headers"} {
+		known[flag] = true
+	}
+
+	values := make(map[string]string)
+	var problems []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, value := line, "true"
+		if index := strings.IndexRune(line, ' '); index >= 0 {
+			name, value = line[:index], strings.TrimSpace(line[index:])
+		}
+		if index := strings.Index(value, " #"); index >= 0 {
+			value = strings.TrimSpace(value[:index])
+		}
+		name = strings.TrimLeft(name, "-")
+		if !known[name] {
+			problems = append(problems, fmt.Sprintf("line %d: unknown flag %q", i+1, name))
+			continue
+		}
+		if previous, ok := values[name]; ok && repeated[name] {
+			value = previous + "\n" + value
+		}
+		values[name] = value
+	}
+
+	config, err := ConfigFromFlags(values)
+	if err != nil {
+		problems = append(problems, err.(*ConfigError).Problems...)
+	} else {
+		problems = append(problems, config.problems()...)
+	}
+	if len(problems) > 0 {
+		return nil, &ConfigError{Path: path, Problems: problems}
+	}
+	return config, nil
+}
+
+// ConfigFromFlags returns the configuration set by the flag values, keyed by
+// flag name. It is the inverse of FlagValues, flags without a setting are
+// ignored.
+func ConfigFromFlags(values map[string]string) (*Config, error) {
+	c := &Config{}
+	var problems []string
+	visitConfigFields(reflect.ValueOf(c).Elem(), "", func(key, flag string, v reflect.Value) {
+		if value, ok := values[flag]; ok {
+			if err := setFlagValue(v, value); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: %v", flag, err))
+			}
+		}
+	})
+
+	targets := make(map[string]*ConfigTarget)
+	target := func(name string) *ConfigTarget {
+		if targets[name] == nil {
+			targets[name] = &ConfigTarget{Name: name}
+		}
+		return targets[name]
+	}
+	for _, flag := range []string{"upstream-protocols", "upstream-timeouts", "cache-targets", "upstream-headers"} {
+		for _, item := range splitFlagList(values[flag]) {
+			sep := "="
+			if flag == "upstream-headers" {
+				sep = ":"
+			}
+			kv := strings.SplitN(item, sep, 2)
+			if len(kv) != 2 {
+				problems = append(problems, fmt.Sprintf("-%s: invalid entry %q", flag, item))
+				continue
+			}
+			t := target(strings.TrimSpace(kv[0]))
+			switch flag {
+			case "upstream-protocols":
+				t.Protocol = strings.TrimSpace(kv[1])
+			case "upstream-timeouts":
+				t.Timeout = Duration(strings.TrimSpace(kv[1]))
+			case "cache-targets":
+				t.CacheTTL = Duration(strings.TrimSpace(kv[1]))
+			case "upstream-headers":
+				header := strings.SplitN(kv[1], "=", 2)
+				if len(header) != 2 {
+					problems = append(problems, fmt.Sprintf("-%s: invalid entry %q", flag, item))
+					continue
+				}
+				if t.Headers == nil {
+					t.Headers = make(map[string]string)
+				}
+				t.Headers[strings.TrimSpace(header[0])] = strings.TrimSpace(header[1])
+			}
+		}
+	}
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.Upstream.Targets = append(c.Upstream.Targets, *targets[name])
+	}
+
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return c, nil
+}
+
+// Validate checks the settings of c like LoadConfig checks a file
+func (c *Config) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// Masked returns a copy of c with the admin token and the header values of
+// the targets masked
+func (c *Config) Masked() *Config {
+	const mask = "****"
+	masked := *c
+	if c.Admin.Token != nil && *c.Admin.Token != "" {
+		token := mask
+		masked.Admin.Token = &token
+	}
+	masked.Upstream.Targets = make([]ConfigTarget, len(c.Upstream.Targets))
+	for i, t := range c.Upstream.Targets {
+		if t.Headers != nil {
+			headers := make(map[string]string, len(t.Headers))
+			for name := range t.Headers {
+				headers[name] = mask
+			}
+			t.Headers = headers
+		}
+		masked.Upstream.Targets[i] = t
+	}
+	return &masked
+}
+
+// FlagValues returns the values of the flags set by the file, keyed by flag
+// name
+func (c *Config) FlagValues() map[string]string {
+	values := make(map[string]string)
+	visitConfig(reflect.ValueOf(c).Elem(), "", func(key, flag string, v reflect.Value) {
+		values[flag] = flagValue(v)
+	})
+
+	var protocols, timeouts, ttls, headers []string
+	for _, t := range c.Upstream.Targets {
+		if t.Protocol != "" {
+			protocols = append(protocols, t.Name+"="+t.Protocol)
+		}
+		if t.Timeout != "" {
+			timeouts = append(timeouts, t.Name+"="+string(t.Timeout))
+		}
+		if t.CacheTTL != "" {
+			ttls = append(ttls, t.Name+"="+string(t.CacheTTL))
+		}
+		for _, name := range sortedKeys(t.Headers) {
+			headers = append(headers, t.Name+":"+name+"="+t.Headers[name])
+		}
+	}
+	for flag, list := range map[string][]string{
+		"upstream-protocols": protocols,
+		"upstream-timeouts":  timeouts,
+		"cache-targets":      ttls,
+		"upstream-headers":   headers,
+	} {
+		if len(list) > 0 {
+			values[flag] = strings.Join(list, ",")
+		}
+	}
+	return values
+}
+
+// visitConfig calls fn with every setting present in the file, named by its
+// dotted key
+func visitConfig(v reflect.Value, prefix string, fn func(key, flag string, v reflect.Value)) {
+	visitConfigFields(v, prefix, func(key, flag string, v reflect.Value) {
+		if !v.IsNil() {
+			fn(key, flag, v)
+		}
+	})
+}
+
+// visitConfigFields calls fn with every setting which has a flag, present
+// or not
+func visitConfigFields(v reflect.Value, prefix string, fn func(key, flag string, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		key := prefix + field.Tag.Get("yaml")
+		flag := field.Tag.Get("flag")
+		switch {
+		case flag == "" && value.Kind() == reflect.Struct:
+			visitConfigFields(value, key+".", fn)
+		case flag != "":
+			fn(key, flag, value)
+		}
+	}
+}
+
+// setFlagValue sets a setting from its flag value
+func setFlagValue(v reflect.Value, value string) error {
+	if _, ok := v.Interface().(PatternList); ok {
+		v.Set(reflect.ValueOf(PatternList(SplitPatternList(value))))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(splitFlagList(value)))
+	case reflect.Map:
+		m := make(map[string]string)
+		for _, pair := range splitFlagList(value) {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid key=value pair %q", pair)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		v.Set(reflect.ValueOf(m))
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem()).Elem()
+		switch elem.Kind() {
+		case reflect.String:
+			elem.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			elem.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			elem.SetInt(n)
+		}
+		v.Set(elem.Addr())
+	}
+	return nil
+}
+
+// SplitPatternList splits the flag value of a PatternList
+func SplitPatternList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, "\n") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func splitFlagList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// flagValue formats a setting as flag value, lists and maps comma separated
+// and pattern lists newline separated
+func flagValue(v reflect.Value) string {
+	if patterns, ok := v.Interface().(PatternList); ok {
+		return strings.Join(patterns, "\n")
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		return fmt.Sprint(v.Elem().Interface())
+	case reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	case reflect.Map:
+		m := v.Interface().(map[string]string)
+		var pairs []string
+		for _, k := range sortedKeys(m) {
+			pairs = append(pairs, k+"="+m[k])
+		}
+		return strings.Join(pairs, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var headerNamePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// problems validates the settings present in the file
+func (c *Config) problems() []string {
+	var problems []string
+	report := func(key string, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	// values are joined into comma, or for patterns newline, separated flags
+	visitConfig(reflect.ValueOf(c).Elem(), "", func(key, flag string, v reflect.Value) {
+		switch value := v.Interface().(type) {
+		case PatternList:
+			for _, item := range value {
+				if strings.Contains(item, "\n") {
+					report(key, "%q can not contain a line break", item)
+				}
+			}
+		case []string:
+			for _, item := range value {
+				if strings.Contains(item, ",") {
+					report(key, "%q can not contain a comma", item)
+				}
+			}
+		case *Duration:
+			if err := checkDuration(*value); err != nil {
+				report(key, "%v", err)
+			}
+		}
+	})
+
+	l := c.Listeners
+	for _, list := range []struct {
+		key   string
+		items []string
+	}{{"listeners.task", l.Task}, {"listeners.monitoring", l.Monitoring}} {
+		for _, item := range list.items {
+			if _, err := ParseListenAddress(item); err != nil {
+				report(list.key, "%v", err)
+			}
+		}
+	}
+	if l.SocketMode != nil {
+		if _, err := strconv.ParseUint(*l.SocketMode, 8, 32); err != nil {
+			report("listeners.socket_mode", "invalid file mode %q", *l.SocketMode)
+		}
+	}
+
+	tlsConfig := c.TLS
+	cert, key := tlsConfig.ServerCert, tlsConfig.ServerKey
+	switch {
+	case cert != nil && *cert != "" && key != nil && *key != "":
+		if _, err := tls.LoadX509KeyPair(*cert, *key); err != nil {
+			report("tls.server_cert", "%v", err)
+		}
+	default:
+		for _, file := range []struct {
+			key  string
+			path *string
+		}{{"tls.server_cert", cert}, {"tls.server_key", key}} {
+			switch {
+			case file.path == nil:
+			case *file.path == "":
+				report(file.key, "missing")
+			default:
+				if err := checkReadable(*file.path); err != nil {
+					report(file.key, "%v", err)
+				}
+			}
+		}
+	}
+	if dir := tlsConfig.CACertsDir; dir != nil && *dir == "" {
+		report("tls.ca_certs_dir", "missing")
+	} else if dir != nil {
+		for _, err := range checkCADir(*dir) {
+			report("tls.ca_certs_dir", "%v", err)
+		}
+	}
+	if _, err := ParseCertWarnDays(tlsConfig.Expiry.WarnDays); err != nil {
+		report("tls.expiry.warn_days", "%v", err)
+	}
+	if n := tlsConfig.Expiry.ReadyDays; n != nil && *n < 0 {
+		report("tls.expiry.ready_days", "negative number of days %d", *n)
+	}
+
+	names := make(map[string]bool)
+	for i, t := range c.Upstream.Targets {
+		key := fmt.Sprintf("upstream.targets[%d]", i)
+		switch {
+		case t.Name == "":
+			report(key+".name", "missing")
+		case strings.ContainsAny(t.Name, ",=: "):
+			report(key+".name", "invalid target %q", t.Name)
+		case names[t.Name]:
+			report(key+".name", "duplicate target %q", t.Name)
+		}
+		names[t.Name] = true
+		if t.Protocol != "" {
+			if _, err := ParseUpstreamTarget(t.Protocol); err != nil {
+				report(key+".protocol", "%v", err)
+			}
+		}
+		for field, d := range map[string]Duration{"timeout": t.Timeout, "cache_ttl": t.CacheTTL} {
+			if d == "" {
+				continue
+			}
+			if err := checkDuration(d); err != nil {
+				report(key+"."+field, "%v", err)
+			}
+		}
+		for _, name := range sortedKeys(t.Headers) {
+			if !headerNamePattern.MatchString(name) {
+				report(key+".headers", "invalid header name %q", name)
+			}
+			if strings.ContainsAny(t.Headers[name], ",\r\n") {
+				report(key+".headers", "value of %s can not contain a comma or line break", name)
+			}
+		}
+	}
+
+	logging := c.Logging
+	if logging.Level != nil {
+		if _, ok := logLevelRank[*logging.Level]; !ok {
+			report("logging.level", "unknown log level %q", *logging.Level)
+		}
+	}
+	for _, out := range logging.Outputs {
+		switch out {
+		case "stdout", "file", "socket", "syslog":
+		default:
+			report("logging.outputs", "invalid log output %q", out)
+		}
+	}
+	for _, out := range sortedKeys(logging.OutputLevels) {
+		if logging.Outputs != nil && !contains(logging.Outputs, out) {
+			report("logging.output_levels", "log level set for unused log output %q", out)
+		}
+		if _, ok := logLevelRank[logging.OutputLevels[out]]; !ok {
+			report("logging.output_levels", "unknown log level %q of %s", logging.OutputLevels[out], out)
+		}
+	}
+	if logging.Directory != nil && (logging.Outputs == nil || contains(logging.Outputs, "file")) {
+		if err := checkDir(*logging.Directory); err != nil {
+			report("logging.directory", "%v", err)
+		}
+	}
+	rotated := logging.MaxBytes != nil && *logging.MaxBytes > 0
+	if d := logging.RotateInterval; d != nil {
+		if interval, err := time.ParseDuration(string(*d)); err == nil && interval > 0 {
+			rotated = true
+		}
+	}
+	if n := logging.MaxBackups; n != nil && *n < 1 && rotated {
+		report("logging.max_backups", "at least one rotated file must be kept, got %d", *n)
+	}
+	syslog := logging.Syslog
+	if syslog.Network != nil {
+		switch *syslog.Network {
+		case SyslogUDP, SyslogTCP, SyslogTLS:
+		default:
+			report("logging.syslog.network", "invalid syslog network %q", *syslog.Network)
+		}
+	}
+	if syslog.Format != nil && *syslog.Format != SyslogRFC5424 && *syslog.Format != SyslogRFC3164 {
+		report("logging.syslog.format", "invalid syslog format %q", *syslog.Format)
+	}
+	if syslog.Facility != nil {
+		if _, ok := syslogFacilities[*syslog.Facility]; !ok {
+			report("logging.syslog.facility", "invalid syslog facility %q", *syslog.Facility)
+		}
+	}
+	if syslog.CAFile != nil && *syslog.CAFile != "" {
+		if err := checkPEMCerts(*syslog.CAFile); err != nil {
+			report("logging.syslog.ca_file", "%v", err)
+		}
+	}
+
+	if p := c.AccessLog.Path; p != nil && *p != "" && *p != "stdout" {
+		if err := checkDir(filepath.Dir(*p)); err != nil {
+			report("access_log.path", "%v", err)
+		}
+	}
+	if f := c.AccessLog.Format; f != nil {
+		if _, err := NewAccessLog(ioutil.Discard, *f); err != nil {
+			report("access_log.format", "%v", err)
+		}
+	}
+	if p := c.Audit.Path; p != nil && *p != "" {
+		if err := checkDir(filepath.Dir(*p)); err != nil {
+			report("audit.path", "%v", err)
+		}
+	}
+	if n := c.Audit.MaxBackups; n != nil && *n < 1 && (c.Audit.MaxBytes == nil || *c.Audit.MaxBytes > 0) {
+		report("audit.max_backups", "at least one rotated file must be kept, got %d", *n)
+	}
+
+	if _, err := NewRedactor(RedactConfig{Paths: c.Redact.Paths, Patterns: c.Redact.Patterns}); err != nil {
+		report("redact", "%v", err)
+	}
+	if e := c.Tracing.OTLPEndpoint; e != nil && *e != "" {
+		if u, err := url.Parse(*e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			report("tracing.otlp_endpoint", "invalid URL %q", *e)
+		}
+	}
+	if n := c.Readiness.MaxInFlight; n != nil && *n < 0 {
+		report("readiness.max_in_flight", "negative limit %d", *n)
+	}
+	for _, target := range c.Readiness.Targets {
+		if strings.ContainsAny(target, "=: ") {
+			report("readiness.targets", "invalid target %q", target)
+		}
+	}
+	if p := c.RequestIDPrefix; p != nil {
+		if err := CheckRequestIDPrefix(*p); err != nil {
+			report("request_id_prefix", "%v", err)
+		}
+	}
+	return problems
+}
+
+func checkDuration(d Duration) error {
+	parsed, err := time.ParseDuration(string(d))
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("negative duration %s", d)
+	}
+	return nil
+}
+
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+func checkPEMCerts(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in %s", path)
+	}
+	return nil
+}
+
+// checkCADir checks that the files below dir are readable and that there is
+// at least one certificate among them. Other files are skipped when loading
+// the CAs, so they are allowed.
+func checkCADir(dir string) []error {
+	if err := checkDir(dir); err != nil {
+		return []error{err}
+	}
+	var errs []error
+	found := false
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		found = found || x509.NewCertPool().AppendCertsFromPEM(data)
+		return nil
+	})
+	if !found && len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("no certificates in %s", dir))
+	}
+	return errs
+}
+
+func contains(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configFlags are the flag values set by each of the valid files below
+var configFlags = map[string]string{
+	"log-level":            "debug",
+	"log-output":           "stdout,file",
+	"monitoring-plaintext": "true",
+	"upstream-port":        "12000",
+	"upstream-protocols":   "worker-1=h2",
+	"upstream-timeouts":    "worker-1=5s",
+	"redact-patterns":      `\d{3,4}-\d{4}` + "\nsecret",
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		// problems are substrings of the reported problems, in order
+		problems []string
+	}{
+		{
+			name: "yaml",
+			file: "goproxy.yaml",
+			content: `
+listeners:
+  monitoring_plaintext: true
+logging:
+  level: debug
+  outputs: [stdout, file]
+upstream:
+  port: "12000"
+  targets:
+    - name: worker-1
+      protocol: h2
+      timeout: 5s
+redact:
+  patterns: ['\d{3,4}-\d{4}', secret]
+`,
+			want: configFlags,
+		},
+		{
+			name: "toml",
+			file: "goproxy.toml",
+			content: `
+[listeners]
+monitoring_plaintext = true
+
+[logging]
+level = "debug"
+outputs = ["stdout", "file"]
+
+[upstream]
+port = "12000"
+
+[[upstream.targets]]
+name = "worker-1"
+protocol = "h2"
+timeout = "5s"
+
+[redact]
+patterns = ['\d{3,4}-\d{4}', "secret"]
+`,
+			want: configFlags,
+		},
+		{
+			name: "legacy",
+			file: "goproxy.conf",
+			content: `
+# flags of earlier releases
+-log-level debug
+--log-output stdout,file  # comment
+monitoring-plaintext
+upstream-port 12000
+upstream-protocols worker-1=h2
+upstream-timeouts worker-1=5s
+redact-patterns \d{3,4}-\d{4}
+redact-patterns secret
+`,
+			want: configFlags,
+		},
+		{
+			name: "empty yaml",
+			file: "goproxy.yml",
+			want: map[string]string{},
+		},
+		{
+			name:     "yaml unknown key and invalid values",
+			file:     "goproxy.yaml",
+			content:  "logging:\n  levle: debug\nshutdown:\n  timeout: soon\nredact:\n  paths: ['$.a,b']\n",
+			problems: []string{"levle", `redact.paths: "$.a,b" can not contain a comma`, "shutdown.timeout"},
+		},
+		{
+			name:     "toml unknown key",
+			file:     "goproxy.toml",
+			content:  "[logging]\nlevle = \"debug\"\n",
+			problems: []string{"logging.levle: unknown key"},
+		},
+		{
+			name:     "legacy unknown flag and invalid value",
+			file:     "goproxy.conf",
+			content:  "log-level debug\nlog-levle debug\nlog-max-payload many\n",
+			problems: []string{`line 2: unknown flag "log-levle"`, "-log-max-payload"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := LoadConfig(path)
+			if tt.problems != nil {
+				cerr, ok := err.(*ConfigError)
+				if !ok {
+					t.Fatalf("error %v, want a *ConfigError", err)
+				}
+				if cerr.Path != path || len(cerr.Problems) != len(tt.problems) {
+					t.Fatalf("problems in %s: %q, want %q", cerr.Path, cerr.Problems, tt.problems)
+				}
+				for i, problem := range cerr.Problems {
+					if !strings.Contains(problem, tt.problems[i]) {
+						t.Errorf("problem %q, want %q", problem, tt.problems[i])
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.FlagValues(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FlagValues = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyConfigFile(t *testing.T) {
+	for path, want := range map[string]bool{
+		"goproxy.yaml": false,
+		"goproxy.YML":  false,
+		"goproxy.toml": false,
+		"goproxy.conf": true,
+		"goproxy":      true,
+	} {
+		if got := LegacyConfigFile(path); got != want {
+			t.Errorf("LegacyConfigFile(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestConfigFromFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		err    bool
+	}{
+		{name: "valid files", values: configFlags},
+		{
+			name: "every kind of setting",
+			values: map[string]string{
+				"log-output-levels":   "file=debug,stdout=warn",
+				"log-max-bytes":       "1048576",
+				"log-compress":        "false",
+				"cache-key-headers":   "Accept,X-Tenant",
+				"upstream-headers":    "worker-1:X-A=1,worker-1:X-B=2,worker-2:X-C=3",
+				"cache-targets":       "worker-2=1m",
+				"request-id-prefix":   "edge",
+				"redact-patterns":     "a,b",
+				"shutdown-timeout":    "30s",
+				"ready-max-in-flight": "10",
+			},
+		},
+		{name: "empty", values: map[string]string{}},
+		{name: "invalid number", values: map[string]string{"log-max-bytes": "1MB"}, err: true},
+		{name: "invalid bool", values: map[string]string{"log-compress": "maybe"}, err: true},
+		{name: "invalid pair", values: map[string]string{"log-output-levels": "file"}, err: true},
+		{name: "invalid target entry", values: map[string]string{"upstream-timeouts": "worker-1"}, err: true},
+		{name: "invalid header entry", values: map[string]string{"upstream-headers": "worker-1:X-A"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ConfigFromFlags(tt.values)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if got := config.FlagValues(); !reflect.DeepEqual(got, tt.values) {
+				t.Errorf("FlagValues = %q, want %q", got, tt.values)
+			}
+		})
+	}
+}
@@ -22,6 +22,7 @@ func makeReceiveAndForwardEndpoint(psvc Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(ReceiveAndForwardRequest)
 		output, err := psvc.ReceiveAndForward(ctx, req)
+		output.Target = req.Body.TargetURL
 		if err != nil {
 			return output, err
 		}
@@ -30,8 +31,8 @@ func makeReceiveAndForwardEndpoint(psvc Service) endpoint.Endpoint {
 }
 
 func makeHealthCheckEndpoint(psvc Service) endpoint.Endpoint {
-	return func(ctx context.Context, _ interface{}) (interface{}, error) {
-		output, err := psvc.HealthCheck(ctx)
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		output, err := psvc.HealthCheck(ctx, request.(HealthCheckRequest))
 		return output, err
 	}
 }
@@ -44,17 +45,20 @@ func makeVersionEndpoint(psvc Service) endpoint.Endpoint {
 }
 
 //MakeEndpointMiddlewares orchastrate all required middlewares
-func MakeEndpointMiddlewares(endpoints Endpoints, logger log.Logger) Endpoints {
+func MakeEndpointMiddlewares(endpoints Endpoints, logger log.Logger, redactor *Redactor, tracer *Tracer) Endpoints {
 
 	//ReceiveAndForward Middlewares
 	endpoints.ReceiveAndForward = EndpointRequestValidationMiddleware()(endpoints.ReceiveAndForward)
-	endpoints.ReceiveAndForward = EndpointLoggingMiddleware(logger)(endpoints.ReceiveAndForward)
+	endpoints.ReceiveAndForward = EndpointLoggingMiddleware(logger, redactor)(endpoints.ReceiveAndForward)
+	endpoints.ReceiveAndForward = EndpointTracingMiddleware(tracer, "/task")(endpoints.ReceiveAndForward)
 
 	// HealthCheck Middlewares
-	endpoints.HealthCheck = EndpointLoggingMiddleware(logger)(endpoints.HealthCheck)
+	endpoints.HealthCheck = EndpointLoggingMiddleware(logger, redactor)(endpoints.HealthCheck)
+	endpoints.HealthCheck = EndpointTracingMiddleware(tracer, "/health")(endpoints.HealthCheck)
 
 	// Version Middlewares
-	endpoints.Version = EndpointLoggingMiddleware(logger)(endpoints.Version)
+	endpoints.Version = EndpointLoggingMiddleware(logger, redactor)(endpoints.Version)
+	endpoints.Version = EndpointTracingMiddleware(tracer, "/version")(endpoints.Version)
 
 	return endpoints
 }
@@ -1,59 +1,166 @@
 package goproxy
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+)
 
-// Transport Errors
-var (
-	//ErrInternalServerError will be returned in case of http 5xx errors
-	ErrInternalServerError = errors.New("internal server error")
+// Error categories tell clients which party failed
+const (
+	// CategoryClient errors are caused by the request and must not be retried as is
+	CategoryClient = "client"
+	// CategoryProxy errors are failures of the proxy itself
+	CategoryProxy = "proxy"
+	// CategoryUpstream errors are failures reaching or talking to the target
+	CategoryUpstream = "upstream"
+)
+
+// Error is the typed error used across service, endpoint and transport layers.
+// Code is stable and is what clients should branch on.
+type Error struct {
+	Code       int
+	HTTPStatus int
+	Retryable  bool
+	Category   string
+	Message    string
+	cause      error
+}
+
+func newError(code, httpStatus int, category string, retryable bool, message string) *Error {
+	return &Error{
+		Code:       code,
+		HTTPStatus: httpStatus,
+		Retryable:  retryable,
+		Category:   category,
+		Message:    message,
+	}
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return e.Message + ": " + e.cause.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.cause
+}
 
+// Is matches errors of the same code, so wrapped copies match their sentinel
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of e with cause attached
+func (e *Error) Wrap(cause error) *Error {
+	wrapped := *e
+	wrapped.cause = cause
+	return &wrapped
+}
+
+// AsError returns the typed error in err's chain, or ErrInternalServerError
+// wrapping err when there is none.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return ErrInternalServerError.Wrap(err)
+}
+
+// Client Errors (1xxx)
+var (
 	//ErrInvalidContentType will be returned in case of content type is not application/json
-	ErrInvalidContentType = errors.New("invalid content type")
+	ErrInvalidContentType = newError(1001, http.StatusUnsupportedMediaType, CategoryClient, false, "invalid content type")
 
 	//ErrMissingTargetURL will be returned in case of target host is not empty
-	ErrMissingTargetURL = errors.New("missing target URL in request body")
+	ErrMissingTargetURL = newError(1002, http.StatusBadRequest, CategoryClient, false, "missing target URL in request body")
 
 	//ErrJSONUnMarshall will be returned in case of failed json parsing.
-	ErrJSONUnMarshall = errors.New("failed to parse json")
+	ErrJSONUnMarshall = newError(1003, http.StatusBadRequest, CategoryClient, false, "failed to parse json")
 
 	//ErrEmptyRequestBody will be returned in case of request body is empty
-	ErrEmptyRequestBody = errors.New("empty request body")
-
-	//ErrReadingResponseBody will be returned in case of response body is empty
-	ErrReadingResponseBody = errors.New("empty response body")
+	ErrEmptyRequestBody = newError(1004, http.StatusBadRequest, CategoryClient, false, "empty request body")
 
 	//ErrMalformedRequest will be returned in case of request sent is invalid
-	ErrMalformedRequest = errors.New("request not formed correctly")
+	ErrMalformedRequest = newError(1005, http.StatusBadRequest, CategoryClient, false, "request not formed correctly")
 
-	// ErrRequestTimeout will be returned in case of request timed out
-	ErrRequestTimeout = errors.New("request timeout")
+	// ErrBadUpstreamURL will be returned in case of the target host can not be resolved
+	ErrBadUpstreamURL = newError(1006, http.StatusBadRequest, CategoryClient, false, "upstream host not found")
 
-	// ErrFailedCreatingNewRequest
-	ErrFailedCreatingNewRequest = errors.New("failed creating new request")
+	// ErrUnauthorized will be returned in case of an admin request without a valid token
+	ErrUnauthorized = newError(1007, http.StatusUnauthorized, CategoryClient, false, "unauthorized")
 )
 
-// Endpoint Errors
+// Proxy Errors (2xxx)
 var (
+	//ErrInternalServerError will be returned in case of http 5xx errors
+	ErrInternalServerError = newError(2001, http.StatusInternalServerError, CategoryProxy, false, "internal server error")
+
+	// ErrFailedCreatingNewRequest will be returned in case of the upstream request can not be built
+	ErrFailedCreatingNewRequest = newError(2002, http.StatusInternalServerError, CategoryProxy, false, "failed creating new request")
+
 	// ErrTypeAssertion will be returned in case of unknown endpoint
-	ErrTypeAssertion = errors.New("failed to type assert")
+	ErrTypeAssertion = newError(2003, http.StatusInternalServerError, CategoryProxy, false, "failed to type assert")
+
+	// ErrCertLoadFailed will be returned in case of a certificate can not be loaded
+	ErrCertLoadFailed = newError(2004, http.StatusInternalServerError, CategoryProxy, false, "failed to load certificate")
+
+	// ErrTargetDraining will be returned in case of the target was put into drain mode on the admin API
+	ErrTargetDraining = newError(2005, http.StatusServiceUnavailable, CategoryProxy, true, "target is draining")
 )
 
-// Service Errors
+// Upstream Errors (3xxx)
 var (
 	// ErrUpstreamHealthCheckFailed will be returned in case of upstream server is un healthy
-	ErrUpstreamHealthCheckFailed = errors.New("upstream health check failed")
+	ErrUpstreamHealthCheckFailed = newError(3001, http.StatusServiceUnavailable, CategoryUpstream, true, "upstream health check failed")
+
+	// ErrRequestTimeout will be returned in case of request timed out
+	ErrRequestTimeout = newError(3002, http.StatusGatewayTimeout, CategoryUpstream, true, "request timeout")
+
+	//ErrReadingResponseBody will be returned in case of response body can not be read
+	ErrReadingResponseBody = newError(3003, http.StatusInternalServerError, CategoryUpstream, false, "empty response body")
 
-	// ErrBadUpstreamURL
-	ErrBadUpstreamURL = errors.New("upstream host not found")
+	// ErrUpstreamConnectionRefused will be returned in case of upstream refused the connection
+	ErrUpstreamConnectionRefused = newError(3004, http.StatusBadGateway, CategoryUpstream, true, "connection refused")
+
+	// ErrUpstreamRequestFailed will be returned in case of any other failure talking to upstream
+	ErrUpstreamRequestFailed = newError(3005, http.StatusBadGateway, CategoryUpstream, true, "upstream request failed")
+
+	// ErrUpstreamTLSHandshake will be returned in case of the TLS handshake with upstream failed
+	ErrUpstreamTLSHandshake = newError(3006, http.StatusBadGateway, CategoryUpstream, false, "upstream TLS handshake failed")
+
+	// ErrUpstreamDNSFailed will be returned in case of the target host could not be resolved temporarily
+	ErrUpstreamDNSFailed = newError(3007, http.StatusBadGateway, CategoryUpstream, true, "upstream DNS lookup failed")
+
+	// ErrUpstreamConnectionReset will be returned in case of upstream reset the connection
+	ErrUpstreamConnectionReset = newError(3008, http.StatusBadGateway, CategoryUpstream, true, "connection reset by upstream")
+
+	// ErrUpstreamEOF will be returned in case of upstream closed the connection without a response
+	ErrUpstreamEOF = newError(3009, http.StatusBadGateway, CategoryUpstream, true, "upstream closed connection")
 )
 
-// Certs Error
-var (
-	// ErrCertLoadFailed will be returned in case of upstream server is un healthy
-	ErrCertLoadFailed = errors.New("failed to load certificate")
+// Error sources, reported in the X-Proxy-Error-Source header
+const (
+	// ErrorSourceProxy marks errors raised by the proxy itself
+	ErrorSourceProxy = "proxy"
+	// ErrorSourceUpstream marks errors returned by, or reaching, the target
+	ErrorSourceUpstream = "upstream"
+	// ErrorSourceHealth marks failed upstream health checks
+	ErrorSourceHealth = "health"
 )
 
+// ErrorSourceHeader tells clients which party an error response originates from
+const ErrorSourceHeader = "X-Proxy-Error-Source"
+
 // Unknown Error
 var (
+	// ErrUnknown is the code reported when an error code can not be encoded
 	ErrUnknown = 3999
 )
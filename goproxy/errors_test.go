@@ -0,0 +1,203 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestErrorCatalog pins the codes and statuses clients depend on
+func TestErrorCatalog(t *testing.T) {
+	tests := []struct {
+		err       *Error
+		code      int
+		status    int
+		category  string
+		retryable bool
+	}{
+		{ErrInvalidContentType, 1001, http.StatusUnsupportedMediaType, CategoryClient, false},
+		{ErrMissingTargetURL, 1002, http.StatusBadRequest, CategoryClient, false},
+		{ErrJSONUnMarshall, 1003, http.StatusBadRequest, CategoryClient, false},
+		{ErrEmptyRequestBody, 1004, http.StatusBadRequest, CategoryClient, false},
+		{ErrMalformedRequest, 1005, http.StatusBadRequest, CategoryClient, false},
+		{ErrBadUpstreamURL, 1006, http.StatusBadRequest, CategoryClient, false},
+		{ErrUnauthorized, 1007, http.StatusUnauthorized, CategoryClient, false},
+		{ErrInternalServerError, 2001, http.StatusInternalServerError, CategoryProxy, false},
+		{ErrFailedCreatingNewRequest, 2002, http.StatusInternalServerError, CategoryProxy, false},
+		{ErrTypeAssertion, 2003, http.StatusInternalServerError, CategoryProxy, false},
+		{ErrCertLoadFailed, 2004, http.StatusInternalServerError, CategoryProxy, false},
+		{ErrTargetDraining, 2005, http.StatusServiceUnavailable, CategoryProxy, true},
+		{ErrUpstreamHealthCheckFailed, 3001, http.StatusServiceUnavailable, CategoryUpstream, true},
+		{ErrRequestTimeout, 3002, http.StatusGatewayTimeout, CategoryUpstream, true},
+		{ErrReadingResponseBody, 3003, http.StatusInternalServerError, CategoryUpstream, false},
+		{ErrUpstreamConnectionRefused, 3004, http.StatusBadGateway, CategoryUpstream, true},
+		{ErrUpstreamRequestFailed, 3005, http.StatusBadGateway, CategoryUpstream, true},
+		{ErrUpstreamTLSHandshake, 3006, http.StatusBadGateway, CategoryUpstream, false},
+		{ErrUpstreamDNSFailed, 3007, http.StatusBadGateway, CategoryUpstream, true},
+		{ErrUpstreamConnectionReset, 3008, http.StatusBadGateway, CategoryUpstream, true},
+		{ErrUpstreamEOF, 3009, http.StatusBadGateway, CategoryUpstream, true},
+	}
+	seen := make(map[int]bool)
+	for _, tt := range tests {
+		t.Run(tt.err.Message, func(t *testing.T) {
+			e := tt.err
+			if e.Code != tt.code || e.HTTPStatus != tt.status || e.Category != tt.category || e.Retryable != tt.retryable {
+				t.Errorf("got %d %d %s retryable=%v, want %d %d %s retryable=%v",
+					e.Code, e.HTTPStatus, e.Category, e.Retryable, tt.code, tt.status, tt.category, tt.retryable)
+			}
+			if seen[e.Code] {
+				t.Errorf("code %d used twice", e.Code)
+			}
+			seen[e.Code] = true
+		})
+	}
+	if ErrUnknown != 3999 {
+		t.Errorf("ErrUnknown = %d, want 3999", ErrUnknown)
+	}
+}
+
+func TestAsError(t *testing.T) {
+	cause := errors.New("boom")
+	wrapped := fmt.Errorf("forwarding: %w", ErrRequestTimeout.Wrap(cause))
+
+	if AsError(nil) != nil {
+		t.Error("AsError(nil) is not nil")
+	}
+	if e := AsError(wrapped); e.Code != ErrRequestTimeout.Code || !errors.Is(e, cause) {
+		t.Errorf("AsError of a wrapped error = %v", e)
+	}
+	if !errors.Is(wrapped, ErrRequestTimeout) || errors.Is(wrapped, ErrUpstreamEOF) {
+		t.Error("errors.Is does not match by code")
+	}
+	if e := AsError(cause); e.Code != ErrInternalServerError.Code || !errors.Is(e, cause) {
+		t.Errorf("AsError of a plain error = %v", e)
+	}
+	if got := ErrRequestTimeout.Wrap(cause).Error(); got != "request timeout: boom" {
+		t.Errorf("Error() = %q", got)
+	}
+	if ErrRequestTimeout.cause != nil {
+		t.Error("Wrap changed the sentinel")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyRequestError(t *testing.T) {
+	opError := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://worker-1:12000/task", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: err}}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want *Error
+	}{
+		{"host not found", &url.Error{Err: &net.DNSError{Err: "no such host", Name: "nope", IsNotFound: true}}, ErrBadUpstreamURL},
+		{"dns failure", &url.Error{Err: &net.DNSError{Err: "server misbehaving", Name: "worker-1", IsTemporary: true}}, ErrUpstreamDNSFailed},
+		{"timeout", &url.Error{Err: timeoutError{}}, ErrRequestTimeout},
+		{"deadline", &url.Error{Op: "Post", Err: context.DeadlineExceeded}, ErrRequestTimeout},
+		{"unknown authority", &url.Error{Err: x509.UnknownAuthorityError{}}, ErrUpstreamTLSHandshake},
+		{"tls alert", errors.New("remote error: tls: bad certificate"), ErrUpstreamTLSHandshake},
+		{"plain HTTP upstream", errors.New("http: server gave HTTP response to HTTPS client"), ErrUpstreamTLSHandshake},
+		{"connection refused", opError(syscall.ECONNREFUSED), ErrUpstreamConnectionRefused},
+		{"connection reset", opError(syscall.ECONNRESET), ErrUpstreamConnectionReset},
+		{"eof", &url.Error{Err: io.EOF}, ErrUpstreamEOF},
+		{"unexpected eof", &url.Error{Err: io.ErrUnexpectedEOF}, ErrUpstreamEOF},
+		{"other", errors.New("something else"), ErrUpstreamRequestFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyRequestError(tt.err)
+			if got.Code != tt.want.Code {
+				t.Errorf("classified as %d %q, want %d %q", got.Code, got.Message, tt.want.Code, tt.want.Message)
+			}
+			if !errors.Is(got, tt.err) {
+				t.Error("cause not kept")
+			}
+		})
+	}
+}
+
+func TestClassifyGRPCError(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		msg  string
+		want *Error
+	}{
+		{codes.DeadlineExceeded, "context deadline exceeded", ErrRequestTimeout},
+		{codes.Unavailable, "dial tcp: lookup nope: no such host", ErrBadUpstreamURL},
+		{codes.Unavailable, "dial tcp 10.0.0.1:12000: connect: connection refused", ErrUpstreamConnectionRefused},
+		{codes.Unavailable, "read: connection reset by peer", ErrUpstreamConnectionReset},
+		{codes.Unavailable, "authentication handshake failed: x509: certificate signed by unknown authority", ErrUpstreamTLSHandshake},
+		{codes.Unavailable, "transport is closing", ErrUpstreamRequestFailed},
+		{codes.InvalidArgument, "bad task", nil},
+		{codes.Internal, "upstream failed", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code.String()+" "+tt.msg, func(t *testing.T) {
+			got := classifyGRPCError(status.New(tt.code, tt.msg))
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("classified as %d, want upstream status", got.Code)
+				}
+				return
+			}
+			if got == nil || got.Code != tt.want.Code {
+				t.Errorf("classified as %v, want %d", got, tt.want.Code)
+			}
+		})
+	}
+}
+
+func TestGRPCCodeFrom(t *testing.T) {
+	tests := []struct {
+		err  *Error
+		want codes.Code
+	}{
+		{ErrInvalidContentType, codes.InvalidArgument},
+		{ErrMissingTargetURL, codes.InvalidArgument},
+		{ErrUnauthorized, codes.Unauthenticated},
+		{ErrInternalServerError, codes.Internal},
+		{ErrTargetDraining, codes.Unavailable},
+		{ErrUpstreamHealthCheckFailed, codes.Unavailable},
+		{ErrRequestTimeout, codes.DeadlineExceeded},
+		{ErrReadingResponseBody, codes.Internal},
+		{ErrUpstreamConnectionRefused, codes.Unavailable},
+	}
+	for _, tt := range tests {
+		if got := grpcCodeFrom(tt.err.HTTPStatus); got != tt.want {
+			t.Errorf("%d %s: %s, want %s", tt.err.Code, tt.err.Message, got, tt.want)
+		}
+	}
+}
+
+func TestCodeFrom(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrRequestTimeout.Wrap(timeoutError{}), http.StatusGatewayTimeout},
+		{ErrReadingResponseBody.Wrap(io.ErrUnexpectedEOF), http.StatusInternalServerError},
+		{ErrTargetDraining, http.StatusServiceUnavailable},
+		{errors.New("untyped"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := codeFrom(tt.err); got != tt.want {
+			t.Errorf("codeFrom(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
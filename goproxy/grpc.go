@@ -0,0 +1,250 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/deepk777/go-proxy/goproxy/pb"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Trailer metadata keys describing an error returned as gRPC status
+const (
+	GRPCErrorCodeKey      = "x-proxy-error-code"
+	GRPCErrorCategoryKey  = "x-proxy-error-category"
+	GRPCErrorRetryableKey = "x-proxy-error-retryable"
+	GRPCErrorSourceKey    = "x-proxy-error-source"
+	GRPCUpstreamStatusKey = "x-proxy-upstream-status"
+)
+
+// GRPCConfig holds the settings of the gRPC transport
+type GRPCConfig struct {
+	// RequestIDPrefix is prepended to generated request ids, usually a node identifier.
+	RequestIDPrefix string
+}
+
+type grpcServer struct {
+	receiveAndForward grpctransport.Handler
+	healthCheck       grpctransport.Handler
+	version           grpctransport.Handler
+}
+
+// MakeGRPCServer returns a gRPC server for the endpoints. creds should carry
+// the same mutual TLS config as the /task listener.
+func MakeGRPCServer(endpoints Endpoints, config GRPCConfig, creds credentials.TransportCredentials) *grpc.Server {
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerBefore(grpcRequestID(config.RequestIDPrefix), grpcExtractTraceContext),
+	}
+
+	server := grpc.NewServer(grpc.Creds(creds))
+	pb.RegisterProxyServer(server, &grpcServer{
+		receiveAndForward: grpctransport.NewServer(
+			endpoints.ReceiveAndForward,
+			decodeGRPCReceiveAndForwardRequest,
+			encodeGRPCReceiveAndForwardResponse,
+			options...,
+		),
+		healthCheck: grpctransport.NewServer(
+			endpoints.HealthCheck,
+			decodeGRPCHealthCheckRequest,
+			encodeGRPCHealthCheckResponse,
+			options...,
+		),
+		version: grpctransport.NewServer(
+			endpoints.Version,
+			decodeGRPCVersionRequest,
+			encodeGRPCVersionResponse,
+			options...,
+		),
+	})
+	return server
+}
+
+func (s *grpcServer) ReceiveAndForward(ctx context.Context, req *pb.ReceiveAndForwardRequest) (*pb.ReceiveAndForwardResponse, error) {
+	_, resp, err := s.receiveAndForward.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.ReceiveAndForwardResponse), nil
+}
+
+func (s *grpcServer) HealthCheck(ctx context.Context, req *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	_, resp, err := s.healthCheck.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.HealthCheckResponse), nil
+}
+
+func (s *grpcServer) Version(ctx context.Context, req *pb.VersionRequest) (*pb.VersionResponse, error) {
+	_, resp, err := s.version.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.VersionResponse), nil
+}
+
+// grpcRequestID is the gRPC counterpart of requestIDHandler. The id is sent
+// back in the response header metadata.
+func grpcRequestID(prefix string) grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		id := firstMetadataValue(md, RequestIDHeader)
+		if !ValidRequestID(id) {
+			id = NewRequestID(prefix)
+		}
+		grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id))
+		return ContextWithRequestID(ctx, id)
+	}
+}
+
+// grpcExtractTraceContext reads the W3C trace context from request metadata
+func grpcExtractTraceContext(ctx context.Context, md metadata.MD) context.Context {
+	sc, ok := ParseTraceparent(firstMetadataValue(md, TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = firstMetadataValue(md, TracestateHeader)
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+func firstMetadataValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func decodeGRPCReceiveAndForwardRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	r := grpcReq.(*pb.ReceiveAndForwardRequest)
+
+	var req ReceiveAndForwardRequest
+	req.Body.TargetURL = r.GetTarget()
+	req.Body.RawTask = r.GetTask()
+	if req.Body.RawTask == nil {
+		req.Body.RawTask = []byte{}
+	}
+	req.Body.TaskContentType = r.GetTaskContentType()
+	if req.Body.TaskContentType == "" {
+		req.Body.TaskContentType = MediaTypeOctet
+	}
+	req.QueryString.IsBeta = r.GetBeta()
+
+	// the envelope of a gRPC request is always a protobuf message
+	req.Headers.ContentType = MediaTypeProtobuf
+	req.Headers.RequestID = RequestIDFromContext(ctx)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	req.Headers.Authorization = firstMetadataValue(md, "authorization")
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if clientIP, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			if prior := firstMetadataValue(md, "x-forwarded-for"); prior != "" {
+				clientIP = prior + "," + clientIP
+			}
+			req.Headers.XForwardedFor = clientIP
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			req.ClientIdentity = certIdentity(tlsInfo.State.PeerCertificates[0])
+		}
+	}
+
+	return req, nil
+}
+
+// encodeGRPCReceiveAndForwardResponse returns errors raised by the proxy as a
+// gRPC status with the error fields in trailer metadata. Upstream responses,
+// including upstream errors, are returned as a response message.
+func encodeGRPCReceiveAndForwardResponse(ctx context.Context, resp interface{}) (interface{}, error) {
+	response, ok := resp.(ReceiveAndForwardResponse)
+	if !ok {
+		return nil, grpcError(ctx, ErrTypeAssertion, ErrorSourceProxy, 0)
+	}
+
+	if response.ErrorDescription != nil {
+		source := response.ErrorSource
+		if source == "" {
+			source = ErrorSourceProxy
+		}
+		return nil, grpcError(ctx, AsError(response.ErrorDescription), source, response.UpstreamStatus)
+	}
+
+	out := &pb.ReceiveAndForwardResponse{
+		Status:         int32(response.Status),
+		Reason:         response.Reason,
+		Error:          int32(response.Error),
+		UpstreamStatus: int32(response.UpstreamStatus),
+		ErrorSource:    response.ErrorSource,
+	}
+	if response.Message != nil {
+		out.Message = []byte(*response.Message)
+	}
+	return out, nil
+}
+
+func decodeGRPCHealthCheckRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return HealthCheckRequest{Probe: ProbeReadiness}, nil
+}
+
+func encodeGRPCHealthCheckResponse(ctx context.Context, resp interface{}) (interface{}, error) {
+	response, ok := resp.(HealthCheckResponse)
+	if !ok {
+		return nil, grpcError(ctx, ErrTypeAssertion, ErrorSourceProxy, 0)
+	}
+	return &pb.HealthCheckResponse{Status: response.Status}, nil
+}
+
+func decodeGRPCVersionRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return VersionRequest{}, nil
+}
+
+func encodeGRPCVersionResponse(ctx context.Context, resp interface{}) (interface{}, error) {
+	response, ok := resp.(VersionResponse)
+	if !ok {
+		return nil, grpcError(ctx, ErrTypeAssertion, ErrorSourceProxy, 0)
+	}
+	return &pb.VersionResponse{Goproxy: response.GoproxyVersion}, nil
+}
+
+// grpcError converts e to a gRPC status and sets the error trailer metadata
+func grpcError(ctx context.Context, e *Error, source string, upstreamStatus int) error {
+	trailer := metadata.Pairs(
+		GRPCErrorCodeKey, strconv.Itoa(e.Code),
+		GRPCErrorCategoryKey, e.Category,
+		GRPCErrorRetryableKey, strconv.FormatBool(e.Retryable),
+		GRPCErrorSourceKey, source,
+	)
+	if upstreamStatus != 0 {
+		trailer.Set(GRPCUpstreamStatusKey, strconv.Itoa(upstreamStatus))
+	}
+	grpc.SetTrailer(ctx, trailer)
+	return status.Error(grpcCodeFrom(e.HTTPStatus), e.Message)
+}
+
+// grpcCodeFrom maps the HTTP status of an error to a gRPC code
+func grpcCodeFrom(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
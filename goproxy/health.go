@@ -0,0 +1,318 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health endpoints on the monitoring listener, /health is an alias of /livez
+// and keeps answering 200 as in earlier releases
+const (
+	LivenessEndpoint  = "/livez"
+	ReadinessEndpoint = "/readyz"
+	HealthEndpoint    = "/health"
+)
+
+// Health probes
+const (
+	ProbeLiveness  = "liveness"
+	ProbeReadiness = "readiness"
+)
+
+// Overall status of a probe. OK is what /health always answered.
+const (
+	HealthStatusOK      = "OK"
+	HealthStatusFailing = "FAILING"
+)
+
+// Status of a single check. Warnings are reported without failing the probe.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// readinessProbeTimeout bounds the health checks of the required targets
+const readinessProbeTimeout = 5 * time.Second
+
+// readinessProbeInterval is how long the outcome of a target health check is
+// reused, so that frequent readiness probes do not add upstream traffic
+const readinessProbeInterval = 10 * time.Second
+
+// CheckResult is the outcome of one check of a probe. Details are only
+// returned in verbose mode.
+type CheckResult struct {
+	Name    string      `json:"name"`
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// HealthConfig holds the dependencies checked for readiness
+type HealthConfig struct {
+	// Certificates must be valid, those close to expiry warn or fail by the
+	// thresholds of the monitor.
+	Certificates *CertMonitor
+	// RequiredTargets must pass their upstream health check and must not drain.
+	RequiredTargets []string
+	// Probe runs the upstream health check of a target.
+	Probe func(ctx context.Context, target string) (int, error)
+	// Tracker holds the requests in flight and the targets in drain mode.
+	Tracker *Tracker
+	// MaxInFlight fails readiness once as many tasks and streams are in
+	// flight. Zero disables the limit.
+	MaxInFlight int
+	// Syslog is the syslog log output, if enabled. Readiness fails while its
+	// queue is full.
+	Syslog *SyslogLogger
+}
+
+// Health runs the liveness and readiness checks
+type Health struct {
+	config   HealthConfig
+	draining int32
+
+	// probeMu is held while the targets are probed, concurrent readiness
+	// checks wait for the outcome instead of probing again
+	probeMu sync.Mutex
+	probes  map[string]targetProbe
+}
+
+type targetProbe struct {
+	status int
+	err    error
+	at     time.Time
+}
+
+// NewHealth returns the checks of config
+func NewHealth(config HealthConfig) *Health {
+	return &Health{config: config, probes: make(map[string]targetProbe)}
+}
+
+// SetDraining fails readiness from now on, the process is shutting down or
+// handing over to an upgrade
+func (h *Health) SetDraining() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// Check runs the checks of probe. The status is HealthStatusFailing when
+// any check failed.
+func (h *Health) Check(ctx context.Context, probe string, verbose bool) HealthCheckResponse {
+	var checks []CheckResult
+	if probe == ProbeLiveness {
+		checks = []CheckResult{h.checkProcess()}
+	} else {
+		checks = []CheckResult{
+			h.checkCertificates(),
+			h.checkUpstreams(ctx),
+			h.checkDraining(),
+			h.checkQueue(),
+		}
+	}
+
+	response := HealthCheckResponse{Status: HealthStatusOK, Checks: checks}
+	for i := range response.Checks {
+		if response.Checks[i].Status == CheckFail {
+			response.Status = HealthStatusFailing
+		}
+		if !verbose {
+			response.Checks[i].Details = nil
+		}
+	}
+	return response
+}
+
+func (h *Health) checkProcess() CheckResult {
+	return CheckResult{
+		Name:    "process",
+		Status:  CheckOK,
+		Details: map[string]interface{}{"goroutines": runtime.NumGoroutine()},
+	}
+}
+
+func (h *Health) checkCertificates() CheckResult {
+	result := CheckResult{Name: "certificates", Status: CheckOK}
+	if h.config.Certificates == nil {
+		return result
+	}
+	certs := h.config.Certificates.Certificates()
+	var problems []string
+	for _, c := range certs {
+		source := c.File
+		if source == "" {
+			source = c.Target
+		}
+		switch {
+		case c.Status == CheckOK:
+		case c.Expired:
+			problems = append(problems, fmt.Sprintf("%s of %s expired", c.Subject, source))
+		case time.Now().Before(c.NotBefore):
+			problems = append(problems, fmt.Sprintf("%s of %s is not valid yet", c.Subject, source))
+		default:
+			problems = append(problems, fmt.Sprintf("%s of %s expires in %d days", c.Subject, source, c.DaysLeft))
+		}
+		result.Status = worseStatus(result.Status, c.Status)
+	}
+	result.Message = strings.Join(problems, "; ")
+	result.Details = certs
+	return result
+}
+
+type upstreamCheck struct {
+	Target         string `json:"target"`
+	Status         string `json:"status"`
+	Draining       bool   `json:"draining,omitempty"`
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func (h *Health) checkUpstreams(ctx context.Context) CheckResult {
+	result := CheckResult{Name: "upstreams", Status: CheckOK}
+	if len(h.config.RequiredTargets) == 0 || h.config.Probe == nil {
+		result.Message = "no required targets"
+		return result
+	}
+
+	probes := h.probeTargets(ctx)
+	details := make([]upstreamCheck, len(h.config.RequiredTargets))
+	for i, target := range h.config.RequiredTargets {
+		details[i] = upstreamCheck{Target: target, Status: CheckOK}
+		if h.config.Tracker != nil && h.config.Tracker.Target(target).Draining {
+			details[i].Status, details[i].Draining = CheckFail, true
+			continue
+		}
+		probe := probes[target]
+		details[i].UpstreamStatus = probe.status
+		if probe.err != nil {
+			details[i].Status, details[i].Error = CheckFail, probe.err.Error()
+		}
+	}
+
+	var failed []string
+	for _, c := range details {
+		if c.Status == CheckFail {
+			failed = append(failed, c.Target)
+		}
+	}
+	if len(failed) > 0 {
+		result.Status = CheckFail
+		result.Message = "unhealthy or draining: " + strings.Join(failed, ", ")
+	}
+	result.Details = details
+	return result
+}
+
+// probeTargets returns the outcome of the health check of every required
+// target, probing those last checked longer than readinessProbeInterval ago
+func (h *Health) probeTargets(ctx context.Context) map[string]targetProbe {
+	h.probeMu.Lock()
+	defer h.probeMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+	defer cancel()
+	now := time.Now()
+	results := make(map[string]targetProbe, len(h.config.RequiredTargets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, target := range h.config.RequiredTargets {
+		if probe, ok := h.probes[target]; ok && now.Sub(probe.at) < readinessProbeInterval {
+			results[target] = probe
+			continue
+		}
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			status, err := h.config.Probe(ctx, target)
+			mu.Lock()
+			results[target] = targetProbe{status: status, err: err, at: now}
+			mu.Unlock()
+		}(target)
+	}
+	wg.Wait()
+
+	// a probe cut short by the caller going away tells nothing about the target
+	if ctx.Err() != context.Canceled {
+		for target, probe := range results {
+			h.probes[target] = probe
+		}
+	}
+	return results
+}
+
+func (h *Health) checkDraining() CheckResult {
+	result := CheckResult{Name: "draining", Status: CheckOK}
+	targets := []string{}
+	if h.config.Tracker != nil {
+		targets = h.config.Tracker.Draining()
+	}
+	if len(targets) > 0 {
+		result.Status = CheckWarn
+		result.Message = "targets draining: " + strings.Join(targets, ", ")
+	}
+	if atomic.LoadInt32(&h.draining) == 1 {
+		result.Status = CheckFail
+		result.Message = "shutting down"
+	}
+	result.Details = map[string]interface{}{"targets": targets}
+	return result
+}
+
+func (h *Health) checkQueue() CheckResult {
+	result := CheckResult{Name: "queue", Status: CheckOK}
+	details := make(map[string]interface{})
+	var problems []string
+
+	if h.config.Tracker != nil {
+		inFlight := len(h.config.Tracker.InFlight())
+		details["in_flight"] = inFlight
+		if max := h.config.MaxInFlight; max > 0 {
+			details["max_in_flight"] = max
+			if inFlight >= max {
+				result.Status = CheckFail
+				problems = append(problems, fmt.Sprintf("%d requests in flight", inFlight))
+			}
+		}
+	}
+	if s := h.config.Syslog; s != nil {
+		queued, connected := s.Queued(), s.Connected()
+		details["syslog_queued"] = queued
+		details["syslog_queue_size"] = s.config.QueueSize
+		details["syslog_connected"] = connected
+		switch {
+		case queued >= s.config.QueueSize:
+			result.Status = CheckFail
+			problems = append(problems, "syslog queue full")
+		case !connected:
+			result.Status = worseStatus(result.Status, CheckWarn)
+			problems = append(problems, "syslog collector not connected")
+		}
+	}
+	result.Message = strings.Join(problems, "; ")
+	result.Details = details
+	return result
+}
+
+var checkStatusRank = map[string]int{CheckOK: 0, CheckWarn: 1, CheckFail: 2}
+
+func worseStatus(a, b string) string {
+	if checkStatusRank[b] > checkStatusRank[a] {
+		return b
+	}
+	return a
+}
+
+// failedChecks returns the names of the failed checks
+func failedChecks(checks []CheckResult) []string {
+	var names []string
+	for _, c := range checks {
+		if c.Status == CheckFail {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
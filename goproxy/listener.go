@@ -0,0 +1,89 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ListenAddress is a network and an address to listen on
+type ListenAddress struct {
+	// Network is one of tcp, tcp4, tcp6 or unix.
+	Network string
+	// Address is host:port, or the socket path for unix.
+	Address string
+}
+
+func (a ListenAddress) String() string {
+	return a.Network + "://" + a.Address
+}
+
+// ParseListenAddress parses network://address, e.g. tcp6://[::1]:443 or
+// unix:///run/goproxy/task.sock. An address without network is tcp.
+func ParseListenAddress(s string) (ListenAddress, error) {
+	s = strings.TrimSpace(s)
+	addr := ListenAddress{Network: "tcp", Address: s}
+	if i := strings.Index(s, "://"); i >= 0 {
+		addr.Network, addr.Address = strings.ToLower(s[:i]), s[i+3:]
+	}
+
+	switch addr.Network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(addr.Address); err != nil {
+			return addr, fmt.Errorf("invalid listen address %q: %v", s, err)
+		}
+	case "unix":
+		if addr.Address == "" {
+			return addr, fmt.Errorf("invalid listen address %q: missing socket path", s)
+		}
+	default:
+		return addr, fmt.Errorf("invalid listen address %q: unsupported network %q", s, addr.Network)
+	}
+	return addr, nil
+}
+
+// Loopback reports whether only local clients can connect to the address,
+// which holds for unix sockets and tcp addresses bound to a loopback host.
+func (a ListenAddress) Loopback() bool {
+	if a.Network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(a.Address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Listen opens a listener on addr. Unix sockets get socketMode, and a stale
+// socket file left behind by a previous process is removed first.
+func Listen(addr ListenAddress, socketMode os.FileMode) (net.Listener, error) {
+	if addr.Network != "unix" {
+		return net.Listen(addr.Network, addr.Address)
+	}
+
+	if info, err := os.Stat(addr.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", addr.Address); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen %s: socket is in use", addr)
+		}
+		if err := os.Remove(addr.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr.Address, socketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -2,10 +2,7 @@ package goproxy
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
-	"net/http"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -13,8 +10,9 @@ import (
 )
 
 type loggingMiddlerware struct {
-	logger log.Logger
-	next   Service
+	logger   log.Logger
+	redactor *Redactor
+	next     Service
 }
 
 func (lmw *loggingMiddlerware) ReceiveAndForward(ctx context.Context, request ReceiveAndForwardRequest) (output ReceiveAndForwardResponse, err error) {
@@ -22,32 +20,28 @@ func (lmw *loggingMiddlerware) ReceiveAndForward(ctx context.Context, request Re
 	defer func(begin time.Time) {
 		ilv := make([]interface{}, 0, 100)
 		logLevel := "Info"
-		var msg interface{}
-
-		if output.Message != nil {
-			_, errMarshal := json.Marshal(&output.Message)
-			if errMarshal != nil {
-				msg = ""
-			} else {
-				msg = output.Message
-			}
-		}
+		ilv = createLogStyleInterface(ilv, traceLogKeyvals(ctx)...)
 
 		ilv = createLogStyleInterface(ilv,
 			"method", "ReceiveAndForward",
-			"response", msg,
+			"response", lmw.redactor.Payload(output.Message),
 			"request-url", request.Body.TargetURL,
 			"x-request-id", request.RequestID,
+			"client-identity", request.ClientIdentity,
 		)
 
+		if output.CacheStatus != "" {
+			ilv = createLogStyleInterface(ilv, "cache", output.CacheStatus)
+		}
+
 		if err != nil {
 			logLevel = "Error"
-			ilv = createLogStyleInterface(ilv, "error_description", err.Error())
-			err = ErrInternalServerError
-
-			if output.Status != 0 && output.Status != http.StatusOK {
-				err = errors.New(strconv.Itoa(output.Status))
-			}
+			e := AsError(err)
+			ilv = createLogStyleInterface(ilv,
+				"error_code", e.Code,
+				"error_description", lmw.redactor.String(err.Error()),
+			)
+			err = e
 		}
 
 		ilv = createLogStyleInterface(ilv, "took", time.Since(begin).String())
@@ -55,22 +49,42 @@ func (lmw *loggingMiddlerware) ReceiveAndForward(ctx context.Context, request Re
 
 	}(time.Now())
 
+	ilv := make([]interface{}, 0, 100)
+	ilv = createLogStyleInterface(ilv, traceLogKeyvals(ctx)...)
+	ilv = createLogStyleInterface(ilv,
+		"method", "ReceiveAndForward",
+		"msg", "forwarding task",
+		"request-url", request.Body.TargetURL,
+		"x-request-id", request.RequestID,
+		"client-identity", request.ClientIdentity,
+		"task", lmw.redactor.Payload(request.Body.Task),
+	)
+	level.Debug(lmw.logger).Log(ilv...)
+
 	output, err = lmw.next.ReceiveAndForward(ctx, request)
 
 	return output, err
 }
 
-func (lmw *loggingMiddlerware) HealthCheck(ctx context.Context) (output HealthCheckResponse, err error) {
+func (lmw *loggingMiddlerware) HealthCheck(ctx context.Context, request HealthCheckRequest) (output HealthCheckResponse, err error) {
 
 	defer func(begin time.Time) {
 		ilv := make([]interface{}, 0, 100)
 		logLevel := "Info"
+		ilv = createLogStyleInterface(ilv, traceLogKeyvals(ctx)...)
 
 		ilv = createLogStyleInterface(ilv,
 			"method", "HealthCheck",
+			"x-request-id", RequestIDFromContext(ctx),
+			"probe", request.Probe,
 			"response", output.Status,
 		)
 
+		if failed := failedChecks(output.Checks); len(failed) > 0 {
+			logLevel = "Warn"
+			ilv = createLogStyleInterface(ilv, "failed_checks", strings.Join(failed, ","))
+		}
+
 		if err != nil {
 			logLevel = "Error"
 			ilv = createLogStyleInterface(ilv, "error_description", err.Error())
@@ -80,7 +94,7 @@ func (lmw *loggingMiddlerware) HealthCheck(ctx context.Context) (output HealthCh
 
 	}(time.Now())
 
-	output, err = lmw.next.HealthCheck(ctx)
+	output, err = lmw.next.HealthCheck(ctx, request)
 	return output, err
 }
 
@@ -88,9 +102,11 @@ func (lmw *loggingMiddlerware) Version(ctx context.Context) (output VersionRespo
 	defer func(begin time.Time) {
 		ilv := make([]interface{}, 0, 100)
 		logLevel := "Info"
+		ilv = createLogStyleInterface(ilv, traceLogKeyvals(ctx)...)
 
 		ilv = createLogStyleInterface(ilv,
 			"method", "Version",
+			"x-request-id", RequestIDFromContext(ctx),
 			"response", output.GoproxyVersion,
 		)
 
@@ -112,6 +128,8 @@ func logMyTask(logger log.Logger, logLevel string, ilv []interface{}) {
 
 	if logLevel == "Error" {
 		level.Error(logger).Log(ilv...)
+	} else if logLevel == "Warn" {
+		level.Warn(logger).Log(ilv...)
 	} else {
 		logger.Log(ilv...)
 	}
@@ -0,0 +1,195 @@
+package goproxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Log levels, from most to least verbose
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logLevelRank = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+// LogScope changes the log level of the records it matches until Expires.
+// RequestID, ClientIdentity and Target are matched against the x-request-id,
+// client-identity and target (or request-url) keys of a record; empty fields
+// match any record.
+type LogScope struct {
+	RequestID      string    `json:"request_id,omitempty"`
+	ClientIdentity string    `json:"client_identity,omitempty"`
+	Target         string    `json:"target,omitempty"`
+	Level          string    `json:"level"`
+	Expires        time.Time `json:"expires"`
+}
+
+func (s LogScope) matches(keyvals []interface{}) bool {
+	requestID, clientIdentity, target := s.RequestID == "", s.ClientIdentity == "", s.Target == ""
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		value, _ := keyvals[i+1].(string)
+		switch keyvals[i] {
+		case "x-request-id":
+			requestID = requestID || value == s.RequestID
+		case "client-identity":
+			clientIdentity = clientIdentity || value == s.ClientIdentity
+		case "target", "request-url":
+			target = target || value == s.Target
+		}
+	}
+	return requestID && clientIdentity && target
+}
+
+// LogLevels holds the log level of the process, which can be changed at
+// runtime, and the scopes overriding it.
+type LogLevels struct {
+	configured string
+
+	mu     sync.RWMutex
+	level  string
+	scopes []LogScope
+}
+
+// NewLogLevels returns LogLevels starting at level. An unknown level is
+// treated as info.
+func NewLogLevels(level string) *LogLevels {
+	if _, ok := logLevelRank[level]; !ok {
+		level = LogLevelInfo
+	}
+	return &LogLevels{configured: level, level: level}
+}
+
+// Level returns the current log level
+func (l *LogLevels) Level() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.level
+}
+
+// SetLevel changes the log level
+func (l *LogLevels) SetLevel(level string) error {
+	if _, ok := logLevelRank[level]; !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	l.mu.Lock()
+	l.level = level
+	l.mu.Unlock()
+	return nil
+}
+
+// Toggle switches between debug and the level the process was started with,
+// or info if that was debug. It returns the new level.
+func (l *LogLevels) Toggle() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.level != LogLevelDebug:
+		l.level = LogLevelDebug
+	case l.configured != LogLevelDebug:
+		l.level = l.configured
+	default:
+		l.level = LogLevelInfo
+	}
+	return l.level
+}
+
+// AddScope adds a scope, which is dropped once it expired
+func (l *LogLevels) AddScope(scope LogScope) error {
+	if _, ok := logLevelRank[scope.Level]; !ok {
+		return fmt.Errorf("unknown log level %q", scope.Level)
+	}
+	l.mu.Lock()
+	l.scopes = append(l.pruneLocked(time.Now()), scope)
+	l.mu.Unlock()
+	return nil
+}
+
+// Scopes returns the scopes which have not expired
+func (l *LogLevels) Scopes() []LogScope {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.scopes = l.pruneLocked(time.Now())
+	return append([]LogScope{}, l.scopes...)
+}
+
+// ClearScopes removes all scopes
+func (l *LogLevels) ClearScopes() {
+	l.mu.Lock()
+	l.scopes = nil
+	l.mu.Unlock()
+}
+
+func (l *LogLevels) pruneLocked(now time.Time) []LogScope {
+	scopes := l.scopes[:0]
+	for _, s := range l.scopes {
+		if now.Before(s.Expires) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// allow reports whether a record is logged at the current level or at the
+// level of a scope matching it
+func (l *LogLevels) allow(keyvals []interface{}) bool {
+	rank := recordRank(keyvals)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if rank >= logLevelRank[l.level] {
+		return true
+	}
+	if len(l.scopes) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, s := range l.scopes {
+		if now.Before(s.Expires) && rank >= logLevelRank[s.Level] && s.matches(keyvals) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordRank returns the rank of the level of a record, info without level
+func recordRank(keyvals []interface{}) int {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == level.Key() {
+			if v, ok := keyvals[i+1].(level.Value); ok {
+				return logLevelRank[v.String()]
+			}
+			break
+		}
+	}
+	return logLevelRank[LogLevelInfo]
+}
+
+// Logger returns a logger passing on the records allowed by l. Records
+// without a level are info records.
+func (l *LogLevels) Logger(next log.Logger) log.Logger {
+	return &levelLogger{next: next, levels: l}
+}
+
+type levelLogger struct {
+	next   log.Logger
+	levels *LogLevels
+}
+
+func (l *levelLogger) Log(keyvals ...interface{}) error {
+	if !l.levels.allow(keyvals) {
+		return nil
+	}
+	return l.next.Log(keyvals...)
+}
@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+)
+
+// FanoutLogger logs every record to all loggers, returning the first error
+func FanoutLogger(loggers ...log.Logger) log.Logger {
+	if len(loggers) == 1 {
+		return loggers[0]
+	}
+	return fanoutLogger(loggers)
+}
+
+type fanoutLogger []log.Logger
+
+func (f fanoutLogger) Log(keyvals ...interface{}) error {
+	var err error
+	for _, l := range f {
+		if lerr := l.Log(keyvals...); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+// MinLevelLogger passes on the records at or above lvl, records without level
+// are info records. It is applied per sink, after the process log level.
+func MinLevelLogger(next log.Logger, lvl string) (log.Logger, error) {
+	rank, ok := logLevelRank[lvl]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q", lvl)
+	}
+	return log.LoggerFunc(func(keyvals ...interface{}) error {
+		if recordRank(keyvals) < rank {
+			return nil
+		}
+		return next.Log(keyvals...)
+	}), nil
+}
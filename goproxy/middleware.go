@@ -2,7 +2,6 @@ package goproxy
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"runtime/debug"
 	"time"
@@ -15,17 +14,48 @@ import (
 type Middleware func(service Service) Service
 
 //ServiceLoggingMiddleware is used for logging on service layer.
-func ServiceLoggingMiddleware(logger log.Logger) Middleware {
+func ServiceLoggingMiddleware(logger log.Logger, redactor *Redactor) Middleware {
 	return func(next Service) Service {
 		return &loggingMiddlerware{
-			next:   next,
-			logger: logger,
+			next:     next,
+			logger:   logger,
+			redactor: redactor,
+		}
+	}
+}
+
+//ServiceCachingMiddleware is used for caching upstream responses on service layer.
+func ServiceCachingMiddleware(cache *ResponseCache) Middleware {
+	return func(next Service) Service {
+		return &cachingMiddleware{
+			next:  next,
+			cache: cache,
+		}
+	}
+}
+
+//ServiceAuditMiddleware is used for recording every forwarded task in the audit trail.
+func ServiceAuditMiddleware(auditor *Auditor) Middleware {
+	return func(next Service) Service {
+		return &auditMiddleware{
+			next:    next,
+			auditor: auditor,
+		}
+	}
+}
+
+//ServiceTrackingMiddleware is used for tracking in-flight tasks and refusing tasks to draining targets.
+func ServiceTrackingMiddleware(tracker *Tracker) Middleware {
+	return func(next Service) Service {
+		return &trackingMiddleware{
+			next:    next,
+			tracker: tracker,
 		}
 	}
 }
 
 //EndpointLoggingMiddleware is used for logging on endpoint layer.
-func EndpointLoggingMiddleware(logger log.Logger) endpoint.Middleware {
+func EndpointLoggingMiddleware(logger log.Logger, redactor *Redactor) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (output interface{}, err error) {
 
@@ -33,34 +63,41 @@ func EndpointLoggingMiddleware(logger log.Logger) endpoint.Middleware {
 				// Taking max hard limit for total KV pair in a single log line as 100
 				ilv := make([]interface{}, 0, 100)
 				logLevel := "Info"
+				ilv = createLogStyleInterface(ilv, traceLogKeyvals(ctx)...)
+				ilv = createLogStyleInterface(ilv, "x-request-id", RequestIDFromContext(ctx))
 
 				if req, ok := request.(ReceiveAndForwardRequest); ok {
 					ilv = createLogStyleInterface(ilv,
-						"x-request-id", req.RequestID,
 						"endpoint", "/task",
 						"client-addr", req.XForwardedFor,
+						"client-identity", req.ClientIdentity,
+						"target", req.Body.TargetURL,
+						"headers", redactor.Headers(req.Headers),
 					)
 				} else if _, ok := request.(VersionRequest); ok {
 					ilv = createLogStyleInterface(ilv, "endpoint", "/version")
-				} else if _, ok := request.(HealthCheckRequest); ok {
-					ilv = createLogStyleInterface(ilv, "endpoint", "/health")
+				} else if req, ok := request.(HealthCheckRequest); ok {
+					endpoint := ReadinessEndpoint
+					if req.Probe == ProbeLiveness {
+						endpoint = LivenessEndpoint
+					}
+					ilv = createLogStyleInterface(ilv, "endpoint", endpoint)
 				} else {
 					ilv = createLogStyleInterface(ilv, "error_description", ErrTypeAssertion.Error())
 				}
 
 				if r := recover(); r != nil {
 					ilv = createLogStyleInterface(ilv, "traceback", string(debug.Stack()))
-					e := fmt.Sprintf("%v", r)
-					err = errors.New(e)
+					err = ErrInternalServerError.Wrap(fmt.Errorf("%v", r))
 				}
 
 				if err != nil {
 					logLevel = "Error"
-					if statusText := ValidHTTPStatusCode(err.Error()); statusText != "" {
-						ilv = createLogStyleInterface(ilv, "error_description", statusText)
-					} else {
-						ilv = createLogStyleInterface(ilv, "error_description", err.Error())
-					}
+					e := AsError(err)
+					ilv = createLogStyleInterface(ilv,
+						"error_code", e.Code,
+						"error_description", redactor.String(e.Error()),
+					)
 					err = nil
 				}
 
@@ -74,17 +111,35 @@ func EndpointLoggingMiddleware(logger log.Logger) endpoint.Middleware {
 	}
 }
 
+// EndpointTracingMiddleware starts a server span around the endpoint.
+func EndpointTracingMiddleware(tracer *Tracer, name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, span := tracer.StartSpan(ctx, name, SpanKindServer)
+			defer span.End()
+
+			span.SetAttribute("x-request-id", RequestIDFromContext(ctx))
+			if req, ok := request.(ReceiveAndForwardRequest); ok {
+				span.SetAttribute("target", req.Body.TargetURL)
+			}
+
+			output, err := next(ctx, request)
+			span.SetError(err)
+			return output, err
+		}
+	}
+}
+
 // EndpointRequestValidationMiddleware is used for Request Validation on endpoint layer.
 func EndpointRequestValidationMiddleware() endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (interface{}, error) {
 			req := request.(ReceiveAndForwardRequest)
-			var rf ReceiveAndForwardResponse
 
 			//Header Validations
-			if req.Headers.ContentType != "application/json" {
-				rf.ErrorDescription = ErrInvalidContentType
-				rf.Reason = ErrInvalidContentType.Error()
+			if _, ok := EnvelopeCodecFor(req.Headers.ContentType); !ok {
+				rf := setReceiveAndForwardResponse(ErrInvalidContentType)
+				rf.Target = req.Body.TargetURL
 				return rf, ErrInvalidContentType
 			}
 
@@ -94,9 +149,7 @@ func EndpointRequestValidationMiddleware() endpoint.Middleware {
 
 			//Body Validation
 			if req.Body.TargetURL == "" {
-				rf.ErrorDescription = ErrMissingTargetURL
-				rf.Reason = ErrMissingTargetURL.Error()
-				return rf, ErrMissingTargetURL
+				return setReceiveAndForwardResponse(ErrMissingTargetURL), ErrMissingTargetURL
 			}
 			return next(ctx, request)
 		}
@@ -2,6 +2,8 @@ package goproxy
 
 import (
 	"encoding/json"
+	"net/http"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 )
@@ -10,6 +12,9 @@ import (
 type Body struct {
 	TargetURL string           `json:"target"`
 	Task      *json.RawMessage `json:"task"`
+	// RawTask and TaskContentType are set by non-JSON envelope codecs
+	RawTask         []byte `json:"-"`
+	TaskContentType string `json:"-"`
 }
 
 //Headers .
@@ -37,6 +42,7 @@ type ReceiveAndForwardRequest struct {
 	Headers
 	QueryString
 	Body
+	ClientIdentity string
 }
 
 //ReceiveAndForwardResponse is response structure for /task
@@ -46,14 +52,24 @@ type ReceiveAndForwardResponse struct {
 	Reason           string           `json:"reason,omitempty"`
 	Error            int              `json:"error,omitempty"`
 	ErrorDescription error
+	UpstreamHeader   http.Header `json:"-"`
+	CacheStatus      string      `json:"-"`
+	Target           string      `json:"-"`
+	UpstreamStatus   int         `json:"-"`
+	ErrorSource      string      `json:"-"`
 }
 
-//HealthCheckRequest is request structure for /healthcheck
-type HealthCheckRequest struct{}
+//HealthCheckRequest is request structure for /livez, /readyz and /health
+type HealthCheckRequest struct {
+	// Probe is ProbeLiveness or ProbeReadiness
+	Probe   string
+	Verbose bool
+}
 
-//HealthCheckResponse is response for /healthcheck endpoint
+//HealthCheckResponse is response for /livez, /readyz and /health endpoints
 type HealthCheckResponse struct {
-	Status string `json:"status"`
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks,omitempty"`
 }
 
 //VersionRequest is request structure for /Version endpoint
@@ -61,5 +77,14 @@ type VersionRequest struct{}
 
 //VersionResponse is response for /Version endpoint
 type VersionResponse struct {
-	GoproxyVersion string `json:"goproxy,omitempty"`
+	GoproxyVersion string            `json:"goproxy,omitempty"`
+	Commit         string            `json:"commit,omitempty"`
+	BuildDate      string            `json:"build_date,omitempty"`
+	Dirty          bool              `json:"dirty"`
+	GoVersion      string            `json:"go_version"`
+	Platform       string            `json:"platform"`
+	Features       []string          `json:"features"`
+	Modules        map[string]string `json:"modules,omitempty"`
+	StartTime      time.Time         `json:"start_time"`
+	Uptime         string            `json:"uptime"`
 }
@@ -0,0 +1,75 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem documents
+const ProblemContentType = "application/problem+json"
+
+// ProblemTypePrefix prefixes the error code to form the problem type URI
+const ProblemTypePrefix = "urn:go-proxy:error:"
+
+// Problem is an RFC 7807 problem document with go-proxy extension members
+type Problem struct {
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Status         int    `json:"status"`
+	Detail         string `json:"detail,omitempty"`
+	Instance       string `json:"instance,omitempty"`
+	Error          int    `json:"error,omitempty"`
+	Category       string `json:"category,omitempty"`
+	Retryable      *bool  `json:"retryable,omitempty"`
+	Target         string `json:"target,omitempty"`
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+}
+
+// newProblem builds a problem document. e may be nil for errors reported by upstream.
+func newProblem(ctx context.Context, status int, e *Error, detail string) Problem {
+	p := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: RequestIDFromContext(ctx),
+	}
+	if e != nil {
+		p.Type = ProblemTypePrefix + strconv.Itoa(e.Code)
+		p.Error = e.Code
+		p.Category = e.Category
+		p.Retryable = &e.Retryable
+	}
+	return p
+}
+
+func encodeProblem(w http.ResponseWriter, p Problem) error {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	return json.NewEncoder(w).Encode(p)
+}
+
+// acceptsProblemJSON reports whether the client explicitly asked for
+// application/problem+json in its Accept header.
+func acceptsProblemJSON(ctx context.Context) bool {
+	accept, _ := ctx.Value(httptransport.ContextKeyRequestAccept).(string)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil || mediaType != ProblemContentType {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if weight, err := strconv.ParseFloat(q, 64); err != nil || weight == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
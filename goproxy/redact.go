@@ -0,0 +1,260 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RedactedValue replaces the value of redacted fields
+const RedactedValue = "[REDACTED]"
+
+// RedactConfig holds the redaction rules applied to logged payloads
+type RedactConfig struct {
+	// Paths are JSON path rules such as $.password, $..token or $.items[*].secret.
+	Paths []string
+	// Patterns are regular expressions whose matches are masked in logged strings.
+	Patterns []string
+	// Headers are request headers whose values are never logged, in addition
+	// to Authorization.
+	Headers []string
+	// MaxPayloadBytes truncates logged payloads, 0 means unlimited.
+	MaxPayloadBytes int
+}
+
+// Redactor masks sensitive fields before payloads reach the logs.
+// A nil Redactor leaves everything untouched.
+type Redactor struct {
+	paths      [][]pathStep
+	patterns   []*regexp.Regexp
+	headers    map[string]bool
+	maxPayload int
+}
+
+type pathStep struct {
+	descend bool   // ".." recursive descent
+	name    string // object key, "*" for any
+	index   int    // array index, -1 for none
+}
+
+// NewRedactor compiles the redaction rules
+func NewRedactor(config RedactConfig) (*Redactor, error) {
+	r := &Redactor{
+		headers:    make(map[string]bool),
+		maxPayload: config.MaxPayloadBytes,
+	}
+
+	for _, p := range config.Paths {
+		steps, err := parseJSONPath(p)
+		if err != nil {
+			return nil, err
+		}
+		r.paths = append(r.paths, steps)
+	}
+
+	for _, p := range config.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	for _, h := range config.Headers {
+		r.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return r, nil
+}
+
+// JSON returns a redacted copy of raw, or nil if raw is not valid JSON.
+func (r *Redactor) JSON(raw *json.RawMessage) *json.RawMessage {
+	if raw == nil || r == nil {
+		return raw
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(*raw, &v); err != nil {
+		return nil
+	}
+	for _, steps := range r.paths {
+		v = redactPath(v, steps)
+	}
+	v = r.maskStrings(v)
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	redacted := json.RawMessage(out)
+	return &redacted
+}
+
+// Payload returns raw redacted and truncated for logging.
+func (r *Redactor) Payload(raw *json.RawMessage) interface{} {
+	if raw == nil {
+		return ""
+	}
+	redacted := r.JSON(raw)
+	if redacted == nil {
+		return ""
+	}
+	if r != nil && r.maxPayload > 0 && len(*redacted) > r.maxPayload {
+		return fmt.Sprintf("%s...(truncated %d bytes)", (*redacted)[:r.maxPayload], len(*redacted)-r.maxPayload)
+	}
+	return redacted
+}
+
+// String masks every pattern match in s.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, RedactedValue)
+	}
+	return s
+}
+
+// Headers returns the non empty request headers with sensitive values masked.
+// Credentials are masked whatever the configuration.
+func (r *Redactor) Headers(h Headers) map[string]string {
+	headers := make(map[string]string)
+	for _, name := range []string{"Authorization", "Content-Type"} {
+		value := headerValue(h, name)
+		if value == "" {
+			continue
+		}
+		if name == "Authorization" || (r != nil && r.headers[name]) {
+			value = RedactedValue
+		}
+		headers[name] = r.String(value)
+	}
+	return headers
+}
+
+func (r *Redactor) maskStrings(v interface{}) interface{} {
+	if len(r.patterns) == 0 {
+		return v
+	}
+	switch t := v.(type) {
+	case string:
+		return r.String(t)
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = r.maskStrings(child)
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = r.maskStrings(child)
+		}
+	}
+	return v
+}
+
+// redactPath replaces every value matched by steps with RedactedValue.
+func redactPath(v interface{}, steps []pathStep) interface{} {
+	if len(steps) == 0 {
+		return RedactedValue
+	}
+	step := steps[0]
+
+	if step.descend {
+		// match at this level, then keep descending into every child
+		v = redactPath(v, append([]pathStep{{name: step.name, index: step.index}}, steps[1:]...))
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, child := range t {
+				t[k] = redactPath(child, steps)
+			}
+		case []interface{}:
+			for i, child := range t {
+				t[i] = redactPath(child, steps)
+			}
+		}
+		return v
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if step.index >= 0 {
+			return v
+		}
+		for k, child := range t {
+			if step.name == "*" || step.name == k {
+				t[k] = redactPath(child, steps[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			if step.name == "*" || step.index == i {
+				t[i] = redactPath(child, steps[1:])
+			}
+		}
+	}
+	return v
+}
+
+// parseJSONPath parses the supported JSON path subset: $, .name, ..name,
+// .*, [*], [n] and ['name'].
+func parseJSONPath(path string) ([]pathStep, error) {
+	invalid := fmt.Errorf("invalid redaction path %q", path)
+	if !strings.HasPrefix(path, "$") {
+		return nil, invalid
+	}
+
+	var steps []pathStep
+	rest := path[1:]
+	for len(rest) > 0 {
+		step := pathStep{index: -1}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.descend = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			rest = rest[1:]
+		case rest[0] == '[':
+		default:
+			return nil, invalid
+		}
+
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, invalid
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case selector == "*":
+				step.name = "*"
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				step.name = selector[1 : len(selector)-1]
+			default:
+				i, err := strconv.Atoi(selector)
+				if err != nil || i < 0 {
+					return nil, invalid
+				}
+				step.index = i
+			}
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.name = rest[:end]
+			rest = rest[end:]
+			if step.name == "" {
+				return nil, invalid
+			}
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return nil, invalid
+	}
+	return steps, nil
+}
@@ -0,0 +1,184 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []pathStep
+		err  bool
+	}{
+		{path: "$.password", want: []pathStep{{name: "password", index: -1}}},
+		{path: "$..token", want: []pathStep{{descend: true, name: "token", index: -1}}},
+		{path: "$.a.b", want: []pathStep{{name: "a", index: -1}, {name: "b", index: -1}}},
+		{path: "$.items[*].secret", want: []pathStep{{name: "items", index: -1}, {name: "*", index: -1}, {name: "secret", index: -1}}},
+		{path: "$.items[0]", want: []pathStep{{name: "items", index: -1}, {index: 0}}},
+		{path: "$['odd.name']", want: []pathStep{{name: "odd.name", index: -1}}},
+		{path: `$["quoted"]`, want: []pathStep{{name: "quoted", index: -1}}},
+		{path: "$.*", want: []pathStep{{name: "*", index: -1}}},
+		{path: "", err: true},
+		{path: "$", err: true},
+		{path: "password", err: true},
+		{path: "$.", err: true},
+		{path: "$.a..", err: true},
+		{path: "$.items[", err: true},
+		{path: "$.items[-1]", err: true},
+		{path: "$.items[x]", err: true},
+		{path: "$x", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parseJSONPath(tt.path)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJSONPath = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactorJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RedactConfig
+		in     string
+		want   string
+	}{
+		{
+			name:   "top level key",
+			config: RedactConfig{Paths: []string{"$.password"}},
+			in:     `{"password":"p","user":"u","nested":{"password":"kept"}}`,
+			want:   `{"nested":{"password":"kept"},"password":"[REDACTED]","user":"u"}`,
+		},
+		{
+			name:   "recursive descent",
+			config: RedactConfig{Paths: []string{"$..token"}},
+			in:     `{"token":"a","list":[{"token":"b"},{"other":1}],"deep":{"deeper":{"token":{"x":1}}}}`,
+			want:   `{"deep":{"deeper":{"token":"[REDACTED]"}},"list":[{"token":"[REDACTED]"},{"other":1}],"token":"[REDACTED]"}`,
+		},
+		{
+			name:   "array wildcard",
+			config: RedactConfig{Paths: []string{"$.items[*].secret"}},
+			in:     `{"items":[{"secret":1,"id":1},{"secret":2,"id":2}]}`,
+			want:   `{"items":[{"id":1,"secret":"[REDACTED]"},{"id":2,"secret":"[REDACTED]"}]}`,
+		},
+		{
+			name:   "array index",
+			config: RedactConfig{Paths: []string{"$.items[1]"}},
+			in:     `{"items":["a","b","c"]}`,
+			want:   `{"items":["a","[REDACTED]","c"]}`,
+		},
+		{
+			name:   "index on an object",
+			config: RedactConfig{Paths: []string{"$.items[0]"}},
+			in:     `{"items":{"0":"a"}}`,
+			want:   `{"items":{"0":"a"}}`,
+		},
+		{
+			name:   "missing path",
+			config: RedactConfig{Paths: []string{"$.nope.deeper"}},
+			in:     `{"a":1}`,
+			want:   `{"a":1}`,
+		},
+		{
+			name:   "pattern with a comma",
+			config: RedactConfig{Patterns: []string{`\d{3,4}-\d{4}`}},
+			in:     `{"phone":"call 555-1234 now","list":["0123-4567"],"n":5551234}`,
+			want:   `{"list":["[REDACTED]"],"n":5551234,"phone":"call [REDACTED] now"}`,
+		},
+		{
+			name:   "paths and patterns",
+			config: RedactConfig{Paths: []string{"$.password"}, Patterns: []string{"secret"}},
+			in:     `{"password":"x","note":"my secret"}`,
+			want:   `{"note":"my [REDACTED]","password":"[REDACTED]"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := json.RawMessage(tt.in)
+			got := r.JSON(&raw)
+			if got == nil || string(*got) != tt.want {
+				t.Errorf("JSON = %s, want %s", got, tt.want)
+			}
+			if string(raw) != tt.in {
+				t.Errorf("input changed to %s", raw)
+			}
+		})
+	}
+}
+
+func TestRedactorInvalid(t *testing.T) {
+	tests := []RedactConfig{
+		{Paths: []string{"password"}},
+		{Patterns: []string{"("}},
+	}
+	for _, config := range tests {
+		if _, err := NewRedactor(config); err == nil {
+			t.Errorf("NewRedactor(%+v) succeeded", config)
+		}
+	}
+
+	r, _ := NewRedactor(RedactConfig{})
+	raw := json.RawMessage(`{"a":`)
+	if got := r.JSON(&raw); got != nil {
+		t.Errorf("invalid JSON redacted to %s", *got)
+	}
+}
+
+func TestRedactorHeaders(t *testing.T) {
+	headers := Headers{Authorization: "Bearer abc", ContentType: "application/json"}
+	tests := []struct {
+		name    string
+		headers []string
+		want    map[string]string
+	}{
+		{"default", []string{"Authorization"}, map[string]string{"Authorization": RedactedValue, "Content-Type": "application/json"}},
+		{"empty list", nil, map[string]string{"Authorization": RedactedValue, "Content-Type": "application/json"}},
+		{"other header", []string{"content-type"}, map[string]string{"Authorization": RedactedValue, "Content-Type": RedactedValue}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(RedactConfig{Headers: tt.headers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Headers(headers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Headers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var r *Redactor
+	if got := r.Headers(headers); got["Authorization"] != RedactedValue {
+		t.Errorf("nil redactor logs Authorization %q", got["Authorization"])
+	}
+	if got := r.Headers(Headers{}); len(got) != 0 {
+		t.Errorf("empty headers logged as %v", got)
+	}
+}
+
+func TestRedactorPayload(t *testing.T) {
+	r, err := NewRedactor(RedactConfig{Paths: []string{"$.password"}, MaxPayloadBytes: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := json.RawMessage(`{"password":"secret","data":"0123456789"}`)
+	got, ok := r.Payload(&raw).(string)
+	if !ok || !strings.HasPrefix(got, `{"data":"0123456789"`) || !strings.HasSuffix(got, "...(truncated 25 bytes)") {
+		t.Errorf("Payload = %v", r.Payload(&raw))
+	}
+	if got := r.Payload(nil); got != "" {
+		t.Errorf("Payload(nil) = %v", got)
+	}
+}
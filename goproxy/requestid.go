@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// RequestIDHeader carries the request id on requests and responses
+const RequestIDHeader = "x-request-id"
+
+// MaxRequestIDLength is the longest client supplied request id accepted
+const MaxRequestIDLength = 128
+
+// MaxRequestIDPrefixLength is the longest prefix of generated request ids,
+// which leaves room for the separator and the UUID
+const MaxRequestIDPrefixLength = MaxRequestIDLength - len("-") - 36
+
+type requestIDContextKey struct{}
+
+// RequestIDFromContext returns the request id stored by the transport layer
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// ContextWithRequestID stores the request id in ctx
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// ValidRequestID reports whether id is short enough and only made of
+// letters, digits and the separators - _ . :
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// CheckRequestIDPrefix returns an error unless the ids generated with prefix
+// are valid request ids
+func CheckRequestIDPrefix(prefix string) error {
+	if len(prefix) > MaxRequestIDPrefixLength {
+		return fmt.Errorf("request id prefix longer than %d characters", MaxRequestIDPrefixLength)
+	}
+	if prefix != "" && !ValidRequestID(prefix) {
+		return fmt.Errorf("invalid request id prefix %q", prefix)
+	}
+	return nil
+}
+
+// NewRequestID returns a random UUIDv4, prefixed with prefix when set
+func NewRequestID(prefix string) string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+	if prefix != "" {
+		id = prefix + "-" + id
+	}
+	return id
+}
+
+// requestIDHandler replaces a missing or invalid x-request-id with a generated
+// one, echoes it in the response and stores it in the request context.
+func requestIDHandler(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !ValidRequestID(id) {
+			id = NewRequestID(prefix)
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(ContextWithRequestID(r.Context(), id)))
+	})
+}
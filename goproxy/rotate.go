@@ -0,0 +1,251 @@
+package goproxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotateConfig controls when a log file is rotated and how long rotated
+// files are kept
+type RotateConfig struct {
+	// MaxBytes rotates the file once it would grow past it, 0 disables.
+	MaxBytes int64
+	// Interval rotates the file every Interval, aligned to UTC, 0 disables.
+	Interval time.Duration
+	// MaxBackups is the number of rotated files kept, at least 1 when the
+	// file is rotated.
+	MaxBackups int
+	// MaxAge removes rotated files last written longer ago, 0 keeps them.
+	MaxAge time.Duration
+	// Compress gzips rotated files.
+	Compress bool
+	// ErrorHandler is told about failed rotations, the file is written to
+	// regardless. Errors go to stderr when it is nil.
+	ErrorHandler func(error)
+}
+
+// rotateRetryInterval is how long a failed rotation is not retried
+const rotateRetryInterval = time.Minute
+
+// OpenLogFile opens path for appending, rotated according to config. Writes
+// are serialized, so the file can be shared by concurrent loggers.
+func OpenLogFile(path string, config RotateConfig) (io.WriteCloser, error) {
+	return openRotatingFile(path, config, 0644)
+}
+
+// rotatingFile is an append only file rotated by size or time.
+// Rotated files are renamed to path.1, path.2 ... path.<MaxBackups>, with a
+// .gz suffix once compressed.
+type rotatingFile struct {
+	path   string
+	config RotateConfig
+	perm   os.FileMode
+
+	mu         sync.Mutex
+	fp         *os.File
+	size       int64
+	rotateAt   time.Time
+	retryAt    time.Time
+	compressed chan error
+}
+
+var _ io.WriteCloser = (*rotatingFile)(nil)
+
+func openRotatingFile(path string, config RotateConfig, perm os.FileMode) (*rotatingFile, error) {
+	if (config.MaxBytes > 0 || config.Interval > 0) && config.MaxBackups < 1 {
+		return nil, fmt.Errorf("rotating %s: at least one rotated file must be kept, max backups is %d", path, config.MaxBackups)
+	}
+	rf := &rotatingFile{
+		path:   path,
+		config: config,
+		perm:   perm,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	// finish a compression cut short by a previous process
+	if config.Compress && config.MaxBackups > 0 {
+		if _, err := os.Stat(rf.backup(1, false)); err == nil {
+			rf.compress(rf.backup(1, false), rf.backup(1, true))
+		}
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	fp, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, rf.perm)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	rf.fp = fp
+	rf.size = info.Size()
+	if rf.config.Interval > 0 {
+		rf.rotateAt = time.Now().Truncate(rf.config.Interval).Add(rf.config.Interval)
+	}
+	return nil
+}
+
+// Write appends p, rotating the file first when it is due. A failed rotation
+// does not lose p, it is reported and retried after rotateRetryInterval.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	var rotateErr error
+	if rf.size > 0 && rf.due(int64(len(p))) && !time.Now().Before(rf.retryAt) {
+		if rotateErr = rf.rotate(); rotateErr != nil {
+			rf.retryAt = time.Now().Add(rotateRetryInterval)
+		}
+	}
+	n, err := rf.fp.Write(p)
+	rf.size += int64(n)
+	rf.mu.Unlock()
+
+	// reported unlocked, the handler may log to this file
+	if rotateErr != nil {
+		rf.reportError(fmt.Errorf("rotating %s: %v", rf.path, rotateErr))
+	}
+	return n, err
+}
+
+func (rf *rotatingFile) reportError(err error) {
+	if rf.config.ErrorHandler != nil {
+		rf.config.ErrorHandler(err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
+
+func (rf *rotatingFile) due(n int64) bool {
+	if rf.config.MaxBytes > 0 && rf.size+n > rf.config.MaxBytes {
+		return true
+	}
+	return !rf.rotateAt.IsZero() && !time.Now().Before(rf.rotateAt)
+}
+
+// backup returns the name of the i-th rotated file
+func (rf *rotatingFile) backup(i int, compressed bool) string {
+	name := fmt.Sprintf("%s.%d", rf.path, i)
+	if compressed {
+		name += ".gz"
+	}
+	return name
+}
+
+// rotate moves the file to the first backup and reopens it. The file is
+// reopened even when moving fails, and the moved file is kept open until the
+// new one is, so writing goes on.
+func (rf *rotatingFile) rotate() error {
+	err := rf.shift()
+	moved := rf.fp
+	if oerr := rf.open(); oerr != nil {
+		return oerr
+	}
+	if cerr := moved.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (rf *rotatingFile) shift() error {
+	// the previous backup keeps its name until it is compressed
+	if err := rf.waitCompressed(); err != nil {
+		return err
+	}
+
+	compress := rf.config.Compress
+	for i := rf.config.MaxBackups; i > 1; i-- {
+		if err := os.Rename(rf.backup(i-1, compress), rf.backup(i, compress)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(rf.path, rf.backup(1, false)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if compress {
+		rf.compress(rf.backup(1, false), rf.backup(1, true))
+	}
+
+	if rf.config.MaxAge > 0 {
+		cutoff := time.Now().Add(-rf.config.MaxAge)
+		for i := 1; i <= rf.config.MaxBackups; i++ {
+			name := rf.backup(i, compress)
+			if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+				os.Remove(name)
+			}
+		}
+	}
+	return nil
+}
+
+// compress gzips src to dst in the background, removing src when done
+func (rf *rotatingFile) compress(src, dst string) {
+	done := make(chan error, 1)
+	rf.compressed = done
+	go func() {
+		done <- gzipFile(src, dst, rf.perm)
+	}()
+}
+
+func (rf *rotatingFile) waitCompressed() error {
+	if rf.compressed == nil {
+		return nil
+	}
+	err := <-rf.compressed
+	rf.compressed = nil
+	return err
+}
+
+func gzipFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// keep the modification time for MaxAge
+	if info, err := in.Stat(); err == nil {
+		os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	err := rf.fp.Close()
+	if cerr := rf.waitCompressed(); err == nil {
+		err = cerr
+	}
+	return err
+}
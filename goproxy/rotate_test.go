@@ -0,0 +1,285 @@
+package goproxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readLogFile returns the content of a log file, gunzipped when compressed
+func readLogFile(t *testing.T, name string, compressed bool) string {
+	t.Helper()
+	fp, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if !compressed {
+		data, err := ioutil.ReadAll(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	zr, err := gzip.NewReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RotateConfig
+		writes []string
+		// files maps backup numbers to their content, 0 is the current file
+		files map[int]string
+	}{
+		{
+			name:   "below max bytes",
+			config: RotateConfig{MaxBytes: 100, MaxBackups: 2},
+			writes: []string{"line-1\n", "line-2\n"},
+			files:  map[int]string{0: "line-1\nline-2\n"},
+		},
+		{
+			name:   "backups shifted",
+			config: RotateConfig{MaxBytes: 10, MaxBackups: 2},
+			writes: []string{"line-1\n", "line-2\n", "line-3\n"},
+			files:  map[int]string{0: "line-3\n", 1: "line-2\n", 2: "line-1\n"},
+		},
+		{
+			name:   "oldest backup dropped",
+			config: RotateConfig{MaxBytes: 10, MaxBackups: 2},
+			writes: []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"},
+			files:  map[int]string{0: "line-4\n", 1: "line-3\n", 2: "line-2\n"},
+		},
+		{
+			name:   "write larger than max bytes",
+			config: RotateConfig{MaxBytes: 4, MaxBackups: 1},
+			writes: []string{"line-1\n", "line-2\n"},
+			files:  map[int]string{0: "line-2\n", 1: "line-1\n"},
+		},
+		{
+			name:   "compressed",
+			config: RotateConfig{MaxBytes: 10, MaxBackups: 2, Compress: true},
+			writes: []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"},
+			files:  map[int]string{0: "line-4\n", 1: "line-3\n", 2: "line-2\n"},
+		},
+		{
+			name:   "not rotated",
+			config: RotateConfig{},
+			writes: []string{"line-1\n", "line-2\n"},
+			files:  map[int]string{0: "line-1\nline-2\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rotate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "proxy.log")
+
+			rf, err := openRotatingFile(path, tt.config, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range tt.writes {
+				if _, err := rf.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rf.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i <= tt.config.MaxBackups+1; i++ {
+				name := path
+				if i > 0 {
+					name = rf.backup(i, tt.config.Compress)
+				}
+				want, ok := tt.files[i]
+				if !ok {
+					if _, err := os.Stat(name); err == nil {
+						t.Errorf("%s kept", filepath.Base(name))
+					}
+					continue
+				}
+				if got := readLogFile(t, name, i > 0 && tt.config.Compress); got != want {
+					t.Errorf("%s = %q, want %q", filepath.Base(name), got, want)
+				}
+				if i > 0 && tt.config.Compress {
+					if _, err := os.Stat(rf.backup(i, false)); err == nil {
+						t.Errorf("%s kept after compressing", filepath.Base(rf.backup(i, false)))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOpenRotatingFile(t *testing.T) {
+	tests := []struct {
+		config RotateConfig
+		err    bool
+	}{
+		{RotateConfig{MaxBytes: 10, MaxBackups: 1}, false},
+		{RotateConfig{}, false},
+		{RotateConfig{MaxBytes: 10}, true},
+		{RotateConfig{Interval: time.Hour}, true},
+		{RotateConfig{MaxBytes: 10, MaxBackups: -1}, true},
+	}
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		rf, err := openRotatingFile(filepath.Join(dir, "proxy.log"), tt.config, 0644)
+		if (err != nil) != tt.err {
+			t.Errorf("%+v: error %v, want error %v", tt.config, err, tt.err)
+		}
+		if err == nil {
+			rf.Close()
+		}
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.log")
+
+	rf, err := openRotatingFile(path, RotateConfig{Interval: time.Hour, MaxBackups: 1}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if !rf.rotateAt.After(time.Now()) || rf.rotateAt.Sub(time.Now()) > time.Hour {
+		t.Fatalf("rotation due at %s", rf.rotateAt)
+	}
+	rf.Write([]byte("line-1\n"))
+	rf.rotateAt = time.Now().Add(-time.Second)
+	rf.Write([]byte("line-2\n"))
+
+	if got := readLogFile(t, rf.backup(1, false), false); got != "line-1\n" {
+		t.Errorf("backup = %q", got)
+	}
+	if got := readLogFile(t, path, false); got != "line-2\n" {
+		t.Errorf("current file = %q", got)
+	}
+	if !rf.rotateAt.After(time.Now()) {
+		t.Errorf("next rotation due at %s", rf.rotateAt)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.log")
+
+	rf, err := openRotatingFile(path, RotateConfig{MaxBytes: 10, MaxBackups: 3, MaxAge: time.Hour}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	ioutil.WriteFile(rf.backup(1, false), []byte("old\n"), 0644)
+	os.Chtimes(rf.backup(1, false), old, old)
+
+	rf.Write([]byte("line-1\n"))
+	rf.Write([]byte("line-2\n"))
+
+	if _, err := os.Stat(rf.backup(2, false)); err == nil {
+		t.Error("backup older than max age kept")
+	}
+	if got := readLogFile(t, rf.backup(1, false), false); got != "line-1\n" {
+		t.Errorf("backup = %q", got)
+	}
+}
+
+func TestRotatingFileFailedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.log")
+
+	var errs []error
+	rf, err := openRotatingFile(path, RotateConfig{
+		MaxBytes:     10,
+		MaxBackups:   1,
+		ErrorHandler: func(err error) { errs = append(errs, err) },
+	}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	// a directory in the way of the backup makes moving the file fail
+	if err := os.MkdirAll(filepath.Join(rf.backup(1, false), "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(errs) != 1 {
+		t.Errorf("%d errors reported, want 1 until the retry interval passed: %v", len(errs), errs)
+	}
+	if got := readLogFile(t, path, false); got != "line-1\nline-2\nline-3\n" {
+		t.Errorf("current file = %q", got)
+	}
+
+	// retried once the interval passed
+	os.RemoveAll(rf.backup(1, false))
+	rf.retryAt = time.Now().Add(-time.Second)
+	rf.Write([]byte("line-4\n"))
+	if got := readLogFile(t, rf.backup(1, false), false); got != "line-1\nline-2\nline-3\n" {
+		t.Errorf("backup after retry = %q", got)
+	}
+}
+
+func TestRotatingFileResumesCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.log")
+	if err := ioutil.WriteFile(path+".1", []byte("line-1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := openRotatingFile(path, RotateConfig{MaxBytes: 10, MaxBackups: 1, Compress: true}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLogFile(t, path+".1.gz", true); got != "line-1\n" {
+		t.Errorf("compressed backup = %q", got)
+	}
+	if _, err := os.Stat(path + ".1"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("uncompressed backup kept: %v", err)
+	}
+}
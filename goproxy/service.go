@@ -6,13 +6,15 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
 //ProxyVersion Information
@@ -29,7 +31,7 @@ const (
 // Service defines a nss proxy interface
 type Service interface {
 	ReceiveAndForward(ctx context.Context, request ReceiveAndForwardRequest) (ReceiveAndForwardResponse, error)
-	HealthCheck(ctx context.Context) (HealthCheckResponse, error)
+	HealthCheck(ctx context.Context, request HealthCheckRequest) (HealthCheckResponse, error)
 	Version(ctx context.Context) (VersionResponse, error)
 }
 
@@ -37,44 +39,33 @@ type service struct {
 	upstreamPort   string
 	upstreamCAFile string
 	upstreamClient *http.Client
+	upstreams      *Upstreams
+	health         *Health
+	build          BuildInfo
 }
 
-// Errorify used to represent http status and error
-type Errorify struct {
-	Status  int
-	Err     error
-	Message string
-}
-
-// NewService creates new service
-func NewService(_ context.Context, upstreamPort string, upstreamClient *http.Client) (Service, error) {
+// NewService creates new service. Targets not configured in upstreams are
+// forwarded over HTTP/1.1 with upstreamClient. HealthCheck runs the checks
+// of health, or always reports OK when it is nil. Version reports build.
+func NewService(_ context.Context, upstreamPort string, upstreamClient *http.Client, upstreams *Upstreams, health *Health, build BuildInfo) (Service, error) {
 	return &service{
 		upstreamPort:   upstreamPort,
 		upstreamClient: upstreamClient,
+		upstreams:      upstreams,
+		health:         health,
+		build:          build,
 	}, nil
 }
 
 //MakeTLSClient to create a tls client
 func MakeTLSClient(caFiles []string) (*http.Client, error) {
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
-	}
-
-	// Append all CAs
-	for _, caFile := range caFiles {
-		caCert, err := ioutil.ReadFile(caFile)
-		if err != nil {
-			return nil, ErrCertLoadFailed
-		}
-		rootCAs.AppendCertsFromPEM(caCert)
+	tlsConfig, err := upstreamTLSConfig(caFiles)
+	if err != nil {
+		return nil, err
 	}
 
 	tr := http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs:            rootCAs,
-			InsecureSkipVerify: true,
-		},
+		TLSClientConfig: tlsConfig,
 		MaxIdleConns:    50,
 		MaxConnsPerHost: 5,
 		IdleConnTimeout: 300 * time.Second,
@@ -88,35 +79,76 @@ func MakeTLSClient(caFiles []string) (*http.Client, error) {
 	return client, nil
 }
 
+// upstreamTLSConfig trusts the system roots and the given CAs
+func upstreamTLSConfig(caFiles []string) (*tls.Config, error) {
+	rootCAs, _ := x509.SystemCertPool()
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	// Append all CAs
+	for _, caFile := range caFiles {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, ErrCertLoadFailed
+		}
+		rootCAs.AppendCertsFromPEM(caCert)
+	}
+
+	return &tls.Config{
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: true,
+	}, nil
+}
+
 func (svc service) ReceiveAndForward(ctx context.Context, request ReceiveAndForwardRequest) (ReceiveAndForwardResponse, error) {
 
 	var rf ReceiveAndForwardResponse
-	inBytes, err := json.Marshal(request.Body.Task)
-	if err != nil {
-		return setReceiveAndForwardResponse(http.StatusBadRequest, ErrJSONUnMarshall.Error()),
-			ErrJSONUnMarshall
+	inBytes := request.Body.RawTask
+	if inBytes == nil {
+		var err error
+		inBytes, err = json.Marshal(request.Body.Task)
+		if err != nil {
+			return setReceiveAndForwardResponse(ErrJSONUnMarshall), ErrJSONUnMarshall.Wrap(err)
+		}
+	}
+
+	target := svc.upstreams.Target(request.Body.TargetURL)
+	if target.Protocol == ProtocolGRPC {
+		return svc.forwardGRPC(ctx, request, inBytes, target)
 	}
+	upstreamClient, upstreamScheme := svc.upstreams.httpClient(target, svc.upstreamClient)
 
 	var upstreamServer string
-	var errStruct Errorify
 	upstreamPort := svc.upstreamPort
-	upstreamServer = DefaultUpstreamScheme + "://" + request.Body.TargetURL
+	upstreamServer = upstreamScheme + "://" + request.Body.TargetURL
 
-	if err := testUpstreamHealth(upstreamServer, upstreamPort, svc.upstreamClient); err != (Errorify{}) {
-		return setReceiveAndForwardResponse(err.Status, ErrUpstreamHealthCheckFailed.Error()),
-			errors.Wrap(err.Err, ErrUpstreamHealthCheckFailed.Error())
+	if status, err := testUpstreamHealth(ctx, upstreamServer, upstreamPort, upstreamClient); err != nil {
+		rf = setReceiveAndForwardResponse(err)
+		rf.ErrorSource = ErrorSourceHealth
+		rf.UpstreamStatus = status
+		return rf, err
 	}
 
 	// Creating Request object
 	upstreamURL := upstreamServer + upstreamPort + UpstreamSelfServiceEndpoint
 	req, err := http.NewRequest("POST", upstreamURL, bytes.NewBuffer(inBytes))
 	if err != nil {
-		return setReceiveAndForwardResponse(http.StatusInternalServerError, ErrFailedCreatingNewRequest.Error()),
-			errors.Wrap(err, ErrFailedCreatingNewRequest.Error())
+		e := ErrFailedCreatingNewRequest.Wrap(err)
+		return setReceiveAndForwardResponse(e), e
 	}
 
+	ctx, span := StartSpan(ctx, "upstream POST", SpanKindClient)
+	defer span.End()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", upstreamURL)
+	span.SetAttribute("upstream.protocol", target.Protocol)
+
 	// Setting Request Headers
-	req = setHeaders(request, req)
+	req = setHeaders(ctx, request, req)
+	for name, values := range target.Headers {
+		req.Header[name] = values
+	}
 
 	// Setting Reqeust Queryparameters
 	q := req.URL.Query()
@@ -125,111 +157,150 @@ func (svc service) ReceiveAndForward(ctx context.Context, request ReceiveAndForw
 		req.URL.RawQuery = q.Encode()
 	}
 
-	resp, err := svc.upstreamClient.Do(req)
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
-		errStruct = classifyRequestError(err)
-		errMessage := errStruct.Err.Error()
-		if errStruct.Message != "" {
-			errMessage = errStruct.Message
-		}
-		return setReceiveAndForwardResponse(errStruct.Status, errMessage),
-			errStruct.Err
+		span.SetError(err)
+		e := classifyRequestError(err)
+		rf = setReceiveAndForwardResponse(e)
+		rf.ErrorSource = ErrorSourceUpstream
+		return rf, e
 	}
 	defer resp.Body.Close()
 
+	span.SetAttribute("http.status_code", resp.StatusCode)
 	rf.Status = resp.StatusCode
+	rf.UpstreamHeader = resp.Header
 	responseBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return setReceiveAndForwardResponse(http.StatusInternalServerError, ErrReadingResponseBody.Error()),
-			errors.Wrap(err, ErrReadingResponseBody.Error())
+		return upstreamReadFailure(resp.StatusCode, err)
 	}
 
 	if err := json.Unmarshal(responseBody, &rf); err != nil {
-		return setReceiveAndForwardResponse(http.StatusInternalServerError, ErrReadingResponseBody.Error()),
-			errors.Wrap(err, ErrReadingResponseBody.Error())
+		return upstreamReadFailure(resp.StatusCode, err)
+	}
+
+	rf.UpstreamStatus = resp.StatusCode
+	if resp.StatusCode >= http.StatusBadRequest {
+		rf.ErrorSource = ErrorSourceUpstream
 	}
 
 	return rf, nil
 }
 
-func setHeaders(request ReceiveAndForwardRequest, req *http.Request) *http.Request {
+func upstreamReadFailure(upstreamStatus int, err error) (ReceiveAndForwardResponse, error) {
+	e := ErrReadingResponseBody.Wrap(err)
+	rf := setReceiveAndForwardResponse(e)
+	rf.ErrorSource = ErrorSourceUpstream
+	rf.UpstreamStatus = upstreamStatus
+	return rf, e
+}
+
+func setHeaders(ctx context.Context, request ReceiveAndForwardRequest, req *http.Request) *http.Request {
 
 	req.Header.Set("Authorization", request.Authorization)
-	req.Header.Set("Content-Type", request.ContentType)
+	contentType := request.ContentType
+	if request.Body.TaskContentType != "" {
+		contentType = request.Body.TaskContentType
+	}
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("X-Forwarded-For", request.XForwardedFor)
-	req.Header.Set("x-request-id", request.RequestID)
+	req.Header.Set(RequestIDHeader, request.RequestID)
+	injectTraceContext(ctx, req)
 
 	return req
 }
 
-func setReceiveAndForwardResponse(httpStatusCode int, reason string) ReceiveAndForwardResponse {
+func setReceiveAndForwardResponse(err *Error) ReceiveAndForwardResponse {
 
 	var rf ReceiveAndForwardResponse
-	rf.Status = httpStatusCode
+	rf.Status = err.HTTPStatus
 	raw := json.RawMessage(http.StatusText(rf.Status))
 	rf.Message = &raw
-	rf.Reason = reason
+	rf.Reason = err.Message
+	rf.Error = err.Code
+	rf.ErrorDescription = err
 
 	return rf
 }
 
-func testUpstreamHealth(upstreamServer, upstreamPort string, upstreamClient *http.Client) Errorify {
+// testUpstreamHealth checks the target's health endpoint. It returns the status
+// upstream answered with, zero when no response was received.
+func testUpstreamHealth(ctx context.Context, upstreamServer, upstreamPort string, upstreamClient *http.Client) (int, *Error) {
 
-	var errStruct Errorify
 	upstreamURL := upstreamServer + upstreamPort + UpstreamHealthEndpoint
 	request, err := http.NewRequest("GET", upstreamURL, nil)
 	if err != nil {
-		errStruct = classifyRequestError(err)
-		return errStruct
+		return 0, ErrFailedCreatingNewRequest.Wrap(err)
+	}
+
+	ctx, span := StartSpan(ctx, "upstream health check", SpanKindClient)
+	defer span.End()
+	span.SetAttribute("http.method", request.Method)
+	span.SetAttribute("http.url", upstreamURL)
+	injectTraceContext(ctx, request)
+	if id := RequestIDFromContext(ctx); id != "" {
+		request.Header.Set(RequestIDHeader, id)
 	}
 
 	resp, err := upstreamClient.Do(request)
 	if err != nil {
-		errStruct = classifyRequestError(err)
-		return errStruct
+		span.SetError(err)
+		return 0, classifyRequestError(err)
 	}
 	defer resp.Body.Close()
+	span.SetAttribute("http.status_code", resp.StatusCode)
 
 	if resp.StatusCode == http.StatusOK {
-		return Errorify{}
+		return resp.StatusCode, nil
 	}
 
 	// For anything not 200 ok
-	errStruct.Status = http.StatusServiceUnavailable
-	errStruct.Err = err
-	return errStruct
+	span.SetError(ErrUpstreamHealthCheckFailed)
+	return resp.StatusCode, ErrUpstreamHealthCheckFailed.Wrap(fmt.Errorf("upstream returned %s", resp.Status))
 }
 
-func classifyRequestError(err error) Errorify {
-
-	var errStruct Errorify
-	errStruct.Status = http.StatusInternalServerError
-	errStruct.Err = err
-
-	switch err := err.(type) {
-	case net.Error:
-		if err.Timeout() {
-			errStruct.Status = http.StatusGatewayTimeout
-			errStruct.Message = "Request timeout"
-		} else if strings.HasSuffix(err.Error(), "no such host") {
-			errStruct.Status = http.StatusBadRequest
-			errStruct.Message = ErrBadUpstreamURL.Error()
-		} else if strings.HasSuffix(err.Error(), "connection refused") {
-			errStruct.Status = http.StatusBadGateway
-			errStruct.Message = "Connection Refused"
+// classifyRequestError maps a failed upstream round trip onto the error catalog.
+func classifyRequestError(err error) *Error {
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsNotFound || strings.HasSuffix(dnsErr.Err, "no such host") {
+			return ErrBadUpstreamURL.Wrap(err)
 		}
+		return ErrUpstreamDNSFailed.Wrap(err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrRequestTimeout.Wrap(err)
+	case errors.As(err, &recordErr), errors.As(err, &unknownAuthErr),
+		errors.As(err, &hostnameErr), errors.As(err, &certErr),
+		strings.Contains(err.Error(), "tls: "), strings.Contains(err.Error(), "x509: "),
+		strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		return ErrUpstreamTLSHandshake.Wrap(err)
+	case errors.Is(err, syscall.ECONNREFUSED), strings.HasSuffix(err.Error(), "connection refused"):
+		return ErrUpstreamConnectionRefused.Wrap(err)
+	case errors.Is(err, syscall.ECONNRESET), strings.HasSuffix(err.Error(), "connection reset by peer"):
+		return ErrUpstreamConnectionReset.Wrap(err)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrUpstreamEOF.Wrap(err)
 	}
-	return errStruct
+	return ErrUpstreamRequestFailed.Wrap(err)
 }
 
-func (service) HealthCheck(_ context.Context) (HealthCheckResponse, error) {
-	return HealthCheckResponse{
-		Status: "OK",
-	}, nil
+func (svc service) HealthCheck(ctx context.Context, request HealthCheckRequest) (HealthCheckResponse, error) {
+	if svc.health == nil {
+		return HealthCheckResponse{
+			Status: HealthStatusOK,
+		}, nil
+	}
+	return svc.health.Check(ctx, request.Probe, request.Verbose), nil
 }
 
-func (service) Version(_ context.Context) (VersionResponse, error) {
-	return VersionResponse{
-		GoproxyVersion: ProxyVersion,
-	}, nil
+func (svc service) Version(_ context.Context) (VersionResponse, error) {
+	return versionResponse(svc.build), nil
 }
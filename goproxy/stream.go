@@ -0,0 +1,531 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/websocket"
+)
+
+// StreamEndpoint relays WebSocket connections and Server-Sent Events for long running tasks
+const StreamEndpoint = "/task/stream"
+
+// EventStreamContentType is the media type of Server-Sent Events
+const EventStreamContentType = "text/event-stream"
+
+// Stream modes, logged with every stream
+const (
+	StreamModeWebSocket = "websocket"
+	StreamModeSSE       = "sse"
+)
+
+// closeGracePeriod is how long the second half of a WebSocket relay may take
+// to finish the close handshake once the first half ended.
+const closeGracePeriod = 5 * time.Second
+
+// StreamConfig holds the settings of the stream relay
+type StreamConfig struct {
+	// UpstreamPort is the port of the target streams are relayed to, e.g. ":12000".
+	UpstreamPort string
+	// IdleTimeout closes a stream after no message passed in either direction
+	// for this long. Zero disables the timeout.
+	IdleTimeout time.Duration
+	// MaxMessageBytes bounds a single WebSocket message, SSE event or request body.
+	MaxMessageBytes int64
+	// Tracker lists open streams as in flight and refuses streams to draining targets.
+	Tracker *Tracker
+}
+
+type streamHandler struct {
+	config    StreamConfig
+	upstreams *Upstreams
+	sse       *http.Client
+	logger    log.Logger
+	redactor  *Redactor
+	tracer    *Tracer
+	upgrader  websocket.Upgrader
+}
+
+// NewStreamHandler returns the handler of StreamEndpoint. The target is taken
+// from the target query parameter and the remaining parameters are passed on
+// to the target's /task/stream. A nil upstreams streams over HTTP/1.1 to
+// every target, as the service forwards tasks.
+func NewStreamHandler(config StreamConfig, upstreams *Upstreams, logger log.Logger, redactor *Redactor, tracer *Tracer) http.Handler {
+	return &streamHandler{
+		config:    config,
+		upstreams: upstreams,
+		// Streams have no overall timeout and must not queue behind the
+		// connection limit of the task client.
+		sse: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: upstreams.streamTLSConfig(),
+				IdleConnTimeout: 90 * time.Second,
+				DialContext:     upstreams.dialContext,
+			},
+		},
+		logger:   logger,
+		redactor: redactor,
+		tracer:   tracer,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: 10 * time.Second,
+			// clients are authenticated by their certificate, not by origin
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+	}
+}
+
+// streamStats is logged once the stream ends
+type streamStats struct {
+	mode             string
+	upstreamStatus   int
+	upstreamMessages int64
+	clientMessages   int64
+	upstreamBytes    int64
+	clientBytes      int64
+	closeReason      string
+}
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	ctx := httptransport.PopulateRequestContext(r.Context(), r)
+	ctx = extractTraceContext(ctx, r)
+	ctx, span := h.tracer.StartSpan(ctx, StreamEndpoint, SpanKindServer)
+	defer span.End()
+
+	var req ReceiveAndForwardRequest
+	req = copyHeaders(req, r)
+	req.Body.TargetURL = r.URL.Query().Get("target")
+	span.SetAttribute("x-request-id", RequestIDFromContext(ctx))
+	span.SetAttribute("target", req.Body.TargetURL)
+
+	var stats streamStats
+	err := h.serve(ctx, w, r, req, &stats)
+	span.SetError(err)
+	h.log(ctx, req, &stats, err, begin)
+}
+
+func (h *streamHandler) serve(ctx context.Context, w http.ResponseWriter, r *http.Request, req ReceiveAndForwardRequest, stats *streamStats) (err error) {
+	if req.Body.TargetURL == "" {
+		encodeError(ctx, ErrMissingTargetURL, w)
+		return ErrMissingTargetURL
+	}
+
+	target := h.upstreams.Target(req.Body.TargetURL)
+	if target.Protocol == ProtocolGRPC {
+		e := ErrMalformedRequest.Wrap(fmt.Errorf("grpc target %s does not stream", req.Body.TargetURL))
+		encodeError(ctx, e, w)
+		return e
+	}
+
+	done, err := h.config.Tracker.Begin(req, true)
+	if err != nil {
+		encodeError(ctx, err, w)
+		return err
+	}
+	defer func() {
+		// only failures reaching upstream tell about the target, not the
+		// ways a relay can end
+		var e *Error
+		if errors.As(err, &e) && e.Category == CategoryUpstream {
+			done(stats.upstreamStatus, e)
+			return
+		}
+		done(stats.upstreamStatus, nil)
+	}()
+
+	query := r.URL.Query()
+	query.Del("target")
+	address := req.Body.TargetURL + h.config.UpstreamPort + StreamEndpoint
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+
+	switch {
+	case websocket.IsWebSocketUpgrade(r):
+		stats.mode = StreamModeWebSocket
+		scheme := "wss"
+		if target.Protocol == ProtocolH2C {
+			scheme = "ws"
+		}
+		return h.relayWebSocket(ctx, w, r, req, scheme+"://"+address, stats)
+	case acceptsEventStream(r):
+		stats.mode = StreamModeSSE
+		client, scheme := h.upstreams.httpClient(target, h.sse)
+		if client != h.sse {
+			// HTTP/2 clients multiplex streams, only the timeout has to go
+			streamClient := *client
+			streamClient.Timeout = 0
+			client = &streamClient
+		}
+		return h.relaySSE(ctx, w, r, req, client, scheme+"://"+address, stats)
+	}
+
+	e := ErrMalformedRequest.Wrap(errors.New("expected a WebSocket upgrade or Accept: " + EventStreamContentType))
+	encodeError(ctx, e, w)
+	return e
+}
+
+// streamHeaders are the headers sent upstream when a stream is opened
+func streamHeaders(ctx context.Context, req ReceiveAndForwardRequest) http.Header {
+	header := make(http.Header)
+	if req.Authorization != "" {
+		header.Set("Authorization", req.Authorization)
+	}
+	header.Set("X-Forwarded-For", req.XForwardedFor)
+	header.Set(RequestIDHeader, req.RequestID)
+	injectTraceHeaders(ctx, header)
+	return header
+}
+
+func (h *streamHandler) relayWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, req ReceiveAndForwardRequest, upstreamURL string, stats *streamStats) error {
+	ctx, span := StartSpan(ctx, "upstream stream", SpanKindClient)
+	defer span.End()
+	span.SetAttribute("http.url", upstreamURL)
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  h.upstreams.streamTLSConfig(),
+		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     websocket.Subprotocols(r),
+		NetDialContext:   h.upstreams.dialContext,
+	}
+	upstream, resp, err := dialer.DialContext(ctx, upstreamURL, streamHeaders(ctx, req))
+	if err != nil {
+		span.SetError(err)
+		var e *Error
+		if resp != nil {
+			stats.upstreamStatus = resp.StatusCode
+			e = ErrUpstreamRequestFailed.Wrap(fmt.Errorf("upstream answered the upgrade with %s", resp.Status))
+		} else {
+			e = classifyRequestError(err)
+		}
+		encodeErrorFrom(ctx, e, ErrorSourceUpstream, w)
+		return e
+	}
+	defer upstream.Close()
+	stats.upstreamStatus = resp.StatusCode
+
+	// the upgrader writes its own response, so w.Header() is not sent
+	responseHeader := http.Header{RequestIDHeader: {req.RequestID}}
+	if protocol := upstream.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+	client, err := h.upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		// the upgrader has answered the client already
+		upstream.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+		return ErrMalformedRequest.Wrap(err)
+	}
+	defer client.Close()
+
+	if h.config.MaxMessageBytes > 0 {
+		client.SetReadLimit(h.config.MaxMessageBytes)
+		upstream.SetReadLimit(h.config.MaxMessageBytes)
+	}
+
+	var idled int32
+	idle := newIdleTimer(h.config.IdleTimeout, func() {
+		atomic.StoreInt32(&idled, 1)
+		message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout")
+		deadline := time.Now().Add(time.Second)
+		client.WriteControl(websocket.CloseMessage, message, deadline)
+		upstream.WriteControl(websocket.CloseMessage, message, deadline)
+		client.Close()
+		upstream.Close()
+	})
+	defer idle.Stop()
+
+	type relayResult struct {
+		fromUpstream bool
+		err          error
+	}
+	results := make(chan relayResult, 2)
+	go func() {
+		err := relayFrames(client, upstream, idle, &stats.upstreamMessages, &stats.upstreamBytes)
+		results <- relayResult{fromUpstream: true, err: err}
+	}()
+	go func() {
+		err := relayFrames(upstream, client, idle, &stats.clientMessages, &stats.clientBytes)
+		results <- relayResult{fromUpstream: false, err: err}
+	}()
+
+	result := <-results
+	select {
+	case <-results:
+	case <-time.After(closeGracePeriod):
+	}
+
+	if atomic.LoadInt32(&idled) == 1 {
+		stats.closeReason = "idle timeout"
+		return nil
+	}
+	stats.closeReason = result.err.Error()
+
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.As(result.err, &closeErr):
+		return nil
+	case errors.Is(result.err, websocket.ErrReadLimit) && result.fromUpstream:
+		return ErrReadingResponseBody.Wrap(result.err)
+	case errors.Is(result.err, websocket.ErrReadLimit):
+		return ErrMalformedRequest.Wrap(result.err)
+	case result.fromUpstream:
+		return ErrUpstreamConnectionReset.Wrap(result.err)
+	}
+	// the client went away without a close handshake
+	return nil
+}
+
+// relayFrames copies messages from src to dst until src fails, then passes
+// the close code on to dst.
+func relayFrames(dst, src *websocket.Conn, idle *idleTimer, messages, size *int64) error {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			code, text := websocket.CloseGoingAway, ""
+			var closeErr *websocket.CloseError
+			switch {
+			case errors.As(err, &closeErr):
+				code, text = closeErr.Code, closeErr.Text
+			case errors.Is(err, websocket.ErrReadLimit):
+				code = websocket.CloseMessageTooBig
+			}
+			// codes reserved for local use can not be sent
+			switch code {
+			case websocket.CloseNoStatusReceived:
+				code = websocket.CloseNormalClosure
+			case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+				code = websocket.CloseGoingAway
+			}
+			dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+			return err
+		}
+
+		idle.Touch()
+		atomic.AddInt64(messages, 1)
+		atomic.AddInt64(size, int64(len(data)))
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (h *streamHandler) relaySSE(ctx context.Context, w http.ResponseWriter, r *http.Request, req ReceiveAndForwardRequest, client *http.Client, upstreamURL string, stats *streamStats) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		e := ErrInternalServerError.Wrap(errors.New("response writer does not flush"))
+		encodeError(ctx, e, w)
+		return e
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctx, span := StartSpan(ctx, "upstream stream", SpanKindClient)
+	defer span.End()
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.url", upstreamURL)
+
+	var body io.Reader
+	if r.Body != nil && r.Body != http.NoBody {
+		if h.config.MaxMessageBytes > 0 {
+			body = http.MaxBytesReader(w, r.Body, h.config.MaxMessageBytes)
+		} else {
+			body = r.Body
+		}
+		stats.clientMessages = 1
+	}
+	upstreamReq, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, body)
+	if err != nil {
+		e := ErrFailedCreatingNewRequest.Wrap(err)
+		encodeError(ctx, e, w)
+		return e
+	}
+	upstreamReq.Header = streamHeaders(ctx, req)
+	upstreamReq.Header.Set("Accept", EventStreamContentType)
+	if req.ContentType != "" {
+		upstreamReq.Header.Set("Content-Type", req.ContentType)
+	}
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		upstreamReq.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	var idled int32
+	idle := newIdleTimer(h.config.IdleTimeout, func() {
+		atomic.StoreInt32(&idled, 1)
+		cancel()
+	})
+	defer idle.Stop()
+
+	resp, err := client.Do(upstreamReq)
+	if err != nil {
+		span.SetError(err)
+		e := classifyRequestError(err)
+		encodeErrorFrom(ctx, e, ErrorSourceUpstream, w)
+		return e
+	}
+	defer resp.Body.Close()
+	stats.upstreamStatus = resp.StatusCode
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
+	for k, values := range resp.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length":
+			continue
+		}
+		w.Header()[k] = values
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		w.Header().Set(ErrorSourceHeader, ErrorSourceUpstream)
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher.Flush()
+
+	err = relayEvents(w, flusher, resp.Body, h.config.MaxMessageBytes, idle, stats)
+	switch {
+	case atomic.LoadInt32(&idled) == 1:
+		stats.closeReason = "idle timeout"
+		return nil
+	case err == nil:
+		stats.closeReason = "upstream closed"
+		return nil
+	case r.Context().Err() != nil:
+		stats.closeReason = "client closed"
+		return nil
+	}
+	stats.closeReason = err.Error()
+	return err
+}
+
+// relayEvents copies an event stream line by line and flushes after every
+// event. Events larger than maxBytes end the stream.
+func relayEvents(w io.Writer, flusher http.Flusher, body io.Reader, maxBytes int64, idle *idleTimer, stats *streamStats) error {
+	reader := bufio.NewReader(body)
+	var eventBytes int64
+	partial := false
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			idle.Touch()
+			eventBytes += int64(len(line))
+			if maxBytes > 0 && eventBytes > maxBytes {
+				return ErrReadingResponseBody.Wrap(fmt.Errorf("event exceeds %d bytes", maxBytes))
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			stats.upstreamBytes += int64(len(line))
+
+			// a blank line ends the event
+			if !partial && err == nil && len(bytes.TrimRight(line, "\r\n")) == 0 {
+				stats.upstreamMessages++
+				eventBytes = 0
+				flusher.Flush()
+			}
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			partial = true
+		case err == io.EOF:
+			flusher.Flush()
+			return nil
+		case err != nil:
+			flusher.Flush()
+			return ErrReadingResponseBody.Wrap(err)
+		default:
+			partial = false
+		}
+	}
+}
+
+// acceptsEventStream reports whether the client asked for Server-Sent Events
+func acceptsEventStream(r *http.Request) bool {
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err == nil && mediaType == EventStreamContentType {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *streamHandler) log(ctx context.Context, req ReceiveAndForwardRequest, stats *streamStats, err error, begin time.Time) {
+	// Taking max hard limit for total KV pair in a single log line as 100
+	ilv := make([]interface{}, 0, 100)
+	logLevel := "Info"
+	ilv = createLogStyleInterface(ilv, traceLogKeyvals(ctx)...)
+	ilv = createLogStyleInterface(ilv,
+		"x-request-id", RequestIDFromContext(ctx),
+		"endpoint", StreamEndpoint,
+		"client-addr", req.XForwardedFor,
+		"client-identity", req.ClientIdentity,
+		"headers", h.redactor.Headers(req.Headers),
+		"target", req.Body.TargetURL,
+	)
+	if stats.mode != "" {
+		ilv = createLogStyleInterface(ilv,
+			"mode", stats.mode,
+			"upstream_messages", atomic.LoadInt64(&stats.upstreamMessages),
+			"client_messages", atomic.LoadInt64(&stats.clientMessages),
+			"upstream_bytes", atomic.LoadInt64(&stats.upstreamBytes),
+			"client_bytes", atomic.LoadInt64(&stats.clientBytes),
+		)
+	}
+	if stats.upstreamStatus != 0 {
+		ilv = createLogStyleInterface(ilv, "upstream_status", stats.upstreamStatus)
+	}
+	if stats.closeReason != "" {
+		ilv = createLogStyleInterface(ilv, "close_reason", stats.closeReason)
+	}
+	if err != nil {
+		logLevel = "Error"
+		e := AsError(err)
+		ilv = createLogStyleInterface(ilv,
+			"error_code", e.Code,
+			"error_description", h.redactor.String(e.Error()),
+		)
+	}
+	ilv = createLogStyleInterface(ilv, "took", time.Since(begin).String())
+	logMyTask(h.logger, logLevel, ilv)
+}
+
+// idleTimer calls onIdle once Touch has not been called for timeout. A zero
+// timeout never fires.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, onIdle)
+	}
+	return t
+}
+
+// Touch restarts the timeout
+func (t *idleTimer) Touch() {
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// Stop releases the timer
+func (t *idleTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
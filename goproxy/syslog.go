@@ -0,0 +1,323 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Syslog message formats
+const (
+	SyslogRFC5424 = "rfc5424"
+	SyslogRFC3164 = "rfc3164"
+)
+
+// Syslog transports, messages are octet counted over tcp and tls (RFC 6587)
+const (
+	SyslogUDP = "udp"
+	SyslogTCP = "tcp"
+	SyslogTLS = "tls"
+)
+
+const (
+	defaultSyslogQueueSize = 10000
+	syslogDialTimeout      = 5 * time.Second
+	syslogWriteTimeout     = 5 * time.Second
+	syslogMinBackoff       = 500 * time.Millisecond
+	syslogMaxBackoff       = 30 * time.Second
+	// syslogCloseTimeout bounds sending the queued messages on Close
+	syslogCloseTimeout = 2 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslog severities of the log levels
+var syslogSeverity = map[int]int{
+	logLevelRank[LogLevelDebug]: 7,
+	logLevelRank[LogLevelInfo]:  6,
+	logLevelRank[LogLevelWarn]:  4,
+	logLevelRank[LogLevelError]: 3,
+}
+
+// SyslogConfig holds the settings of a syslog output
+type SyslogConfig struct {
+	// Network is udp, tcp or tls.
+	Network string
+	// Address is the host:port of the collector.
+	Address string
+	// Format is rfc5424 or rfc3164.
+	Format string
+	// Facility is a facility name such as daemon or local0.
+	Facility string
+	// AppName is the APP-NAME, or TAG with RFC 3164.
+	AppName string
+	// TLSConfig is used with tls, the server name defaults to the host of Address.
+	TLSConfig *tls.Config
+	// QueueSize bounds the messages held while the collector can not be
+	// reached, the oldest are dropped once it is full.
+	QueueSize int
+}
+
+// SyslogLogger is a log.Logger sending every record, JSON encoded, as a
+// syslog message. Records are queued and sent in the background, so logging
+// never blocks on the collector, which is reconnected to with backoff.
+type SyslogLogger struct {
+	config   SyslogConfig
+	facility int
+	hostname string
+	pid      string
+
+	mu      sync.Mutex
+	queue   [][]byte
+	head    int
+	n       int
+	closing bool
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	dropped   uint64
+	connected int32
+}
+
+// NewSyslogLogger validates config and starts sending. The collector does
+// not have to be reachable yet.
+func NewSyslogLogger(config SyslogConfig) (*SyslogLogger, error) {
+	switch config.Network {
+	case SyslogUDP, SyslogTCP, SyslogTLS:
+	default:
+		return nil, fmt.Errorf("invalid syslog network %q", config.Network)
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %v", config.Address, err)
+	}
+	switch config.Format {
+	case SyslogRFC5424, SyslogRFC3164:
+	default:
+		return nil, fmt.Errorf("invalid syslog format %q", config.Format)
+	}
+	facility, ok := syslogFacilities[config.Facility]
+	if !ok {
+		return nil, fmt.Errorf("invalid syslog facility %q", config.Facility)
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultSyslogQueueSize
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	s := &SyslogLogger{
+		config:   config,
+		facility: facility,
+		hostname: hostname,
+		pid:      strconv.Itoa(os.Getpid()),
+		queue:    make([][]byte, config.QueueSize),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Log queues the record
+func (s *SyslogLogger) Log(keyvals ...interface{}) error {
+	var buf bytes.Buffer
+	if err := log.NewJSONLogger(&buf).Log(keyvals...); err != nil {
+		return err
+	}
+	s.enqueue(s.format(syslogSeverity[recordRank(keyvals)], bytes.TrimRight(buf.Bytes(), "\n")))
+	return nil
+}
+
+// Dropped returns the number of messages dropped because the queue was full
+func (s *SyslogLogger) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Connected reports whether the collector is connected
+func (s *SyslogLogger) Connected() bool {
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+// Queued returns the number of messages waiting to be sent
+func (s *SyslogLogger) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// Close sends the queued messages for a short while and disconnects
+func (s *SyslogLogger) Close() error {
+	s.mu.Lock()
+	if !s.closing {
+		s.closing = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	s.signal()
+
+	select {
+	case <-s.done:
+	case <-time.After(syslogCloseTimeout):
+	}
+	return nil
+}
+
+func (s *SyslogLogger) format(severity int, msg []byte) []byte {
+	var buf bytes.Buffer
+	pri := s.facility*8 + severity
+	if s.config.Format == SyslogRFC3164 {
+		fmt.Fprintf(&buf, "<%d>%s %s %s[%s]: ", pri, time.Now().Format(time.Stamp), s.hostname, s.config.AppName, s.pid)
+	} else {
+		fmt.Fprintf(&buf, "<%d>1 %s %s %s %s - - ", pri, time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, s.config.AppName, s.pid)
+	}
+	buf.Write(msg)
+	return buf.Bytes()
+}
+
+func (s *SyslogLogger) enqueue(msg []byte) {
+	s.mu.Lock()
+	if s.n == len(s.queue) {
+		// drop the oldest
+		s.head = (s.head + 1) % len(s.queue)
+		s.n--
+		atomic.AddUint64(&s.dropped, 1)
+	}
+	s.queue[(s.head+s.n)%len(s.queue)] = msg
+	s.n++
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *SyslogLogger) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue returns the oldest message, or false once closing with an empty queue
+func (s *SyslogLogger) dequeue() ([]byte, bool) {
+	for {
+		s.mu.Lock()
+		if s.n > 0 {
+			msg := s.queue[s.head]
+			s.queue[s.head] = nil
+			s.head = (s.head + 1) % len(s.queue)
+			s.n--
+			s.mu.Unlock()
+			return msg, true
+		}
+		closing := s.closing
+		s.mu.Unlock()
+		if closing {
+			return nil, false
+		}
+		<-s.wake
+	}
+}
+
+func (s *SyslogLogger) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+func (s *SyslogLogger) run() {
+	defer close(s.done)
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	backoff := syslogMinBackoff
+	var reported uint64
+
+	for {
+		msg, ok := s.dequeue()
+		if !ok {
+			return
+		}
+		// a message is retried until it is sent, or dropped on close
+		for {
+			if conn == nil {
+				c, err := s.dial()
+				if err != nil {
+					if s.isClosing() {
+						return
+					}
+					select {
+					case <-time.After(backoff):
+					case <-s.stop:
+					}
+					if backoff *= 2; backoff > syslogMaxBackoff {
+						backoff = syslogMaxBackoff
+					}
+					continue
+				}
+				conn = c
+				backoff = syslogMinBackoff
+				atomic.StoreInt32(&s.connected, 1)
+
+				if dropped := s.Dropped(); dropped > reported {
+					notice := fmt.Sprintf(`{"level":"warn","msg":"syslog queue full, log lines dropped","dropped":%d}`, dropped)
+					if s.write(conn, s.format(syslogSeverity[logLevelRank[LogLevelWarn]], []byte(notice))) == nil {
+						reported = dropped
+					}
+				}
+			}
+			if err := s.write(conn, msg); err != nil {
+				conn.Close()
+				conn = nil
+				atomic.StoreInt32(&s.connected, 0)
+				if s.isClosing() {
+					return
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (s *SyslogLogger) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	switch s.config.Network {
+	case SyslogTLS:
+		return tls.DialWithDialer(dialer, "tcp", s.config.Address, s.config.TLSConfig)
+	default:
+		return dialer.Dial(s.config.Network, s.config.Address)
+	}
+}
+
+func (s *SyslogLogger) write(conn net.Conn, msg []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if s.config.Network == SyslogUDP {
+		_, err := conn.Write(msg)
+		return err
+	}
+	framed := make([]byte, 0, len(msg)+8)
+	framed = strconv.AppendInt(framed, int64(len(msg)), 10)
+	framed = append(framed, ' ')
+	framed = append(framed, msg...)
+	_, err := conn.Write(framed)
+	return err
+}
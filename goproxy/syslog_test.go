@@ -0,0 +1,246 @@
+package goproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// newQueuedSyslogLogger returns a logger that queues without sending
+func newQueuedSyslogLogger(config SyslogConfig) *SyslogLogger {
+	return &SyslogLogger{
+		config:   config,
+		facility: syslogFacilities[config.Facility],
+		hostname: "host-1",
+		pid:      "42",
+		queue:    make([][]byte, config.QueueSize),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		log    func(log.Logger) error
+		want   string
+	}{
+		{
+			name:   "rfc5424 info",
+			format: SyslogRFC5424,
+			log:    func(l log.Logger) error { return level.Info(l).Log("msg", "started") },
+			want:   `^<134>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z host-1 goproxy 42 - - \{"level":"info","msg":"started"\}$`,
+		},
+		{
+			name:   "rfc5424 error",
+			format: SyslogRFC5424,
+			log:    func(l log.Logger) error { return level.Error(l).Log("msg", "failed") },
+			want:   `^<131>1 \S+ host-1 goproxy 42 - - \{"level":"error","msg":"failed"\}$`,
+		},
+		{
+			name:   "rfc5424 without level",
+			format: SyslogRFC5424,
+			log:    func(l log.Logger) error { return l.Log("msg", "plain") },
+			want:   `^<134>1 \S+ host-1 goproxy 42 - - \{"msg":"plain"\}$`,
+		},
+		{
+			name:   "rfc3164 warn",
+			format: SyslogRFC3164,
+			log:    func(l log.Logger) error { return level.Warn(l).Log("msg", "slow") },
+			want:   `^<132>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d host-1 goproxy\[42\]: \{"level":"warn","msg":"slow"\}$`,
+		},
+		{
+			name:   "rfc3164 debug",
+			format: SyslogRFC3164,
+			log:    func(l log.Logger) error { return level.Debug(l).Log("msg", "detail") },
+			want:   `^<135>.* goproxy\[42\]: \{"level":"debug","msg":"detail"\}$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newQueuedSyslogLogger(SyslogConfig{Format: tt.format, Facility: "local0", AppName: "goproxy", QueueSize: 1})
+			if err := tt.log(s); err != nil {
+				t.Fatal(err)
+			}
+			msg, _ := s.dequeue()
+			if !regexp.MustCompile(tt.want).Match(msg) {
+				t.Errorf("message %q does not match %s", msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyslogQueueDropsOldest(t *testing.T) {
+	tests := []struct {
+		size    int
+		logged  int
+		dropped uint64
+		want    []string
+	}{
+		{size: 3, logged: 2, dropped: 0, want: []string{"0", "1"}},
+		{size: 3, logged: 3, dropped: 0, want: []string{"0", "1", "2"}},
+		{size: 3, logged: 5, dropped: 2, want: []string{"2", "3", "4"}},
+		{size: 1, logged: 4, dropped: 3, want: []string{"3"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d of %d", tt.logged, tt.size), func(t *testing.T) {
+			s := newQueuedSyslogLogger(SyslogConfig{QueueSize: tt.size})
+			for i := 0; i < tt.logged; i++ {
+				s.enqueue([]byte(strconv.Itoa(i)))
+			}
+			if s.Dropped() != tt.dropped || s.Queued() != len(tt.want) {
+				t.Errorf("dropped %d queued %d, want %d %d", s.Dropped(), s.Queued(), tt.dropped, len(tt.want))
+			}
+			s.closing = true
+			var got []string
+			for {
+				msg, ok := s.dequeue()
+				if !ok {
+					break
+				}
+				got = append(got, string(msg))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// readOctetCounted reads one RFC 6587 octet counted message
+func readOctetCounted(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", fmt.Errorf("invalid length %q", length)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := NewSyslogLogger(SyslogConfig{Network: SyslogTCP, Address: ln.Addr().String(), Format: SyslogRFC5424, Facility: "daemon", AppName: "goproxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	level.Info(s).Log("msg", "first\nline")
+	level.Info(s).Log("msg", "second")
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{`{"level":"info","msg":"first\nline"}`, `{"level":"info","msg":"second"}`} {
+		msg, err := readOctetCounted(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(msg, "<30>1 ") || !strings.HasSuffix(msg, " - - "+want) {
+			t.Errorf("message %q, want %s", msg, want)
+		}
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s, err := NewSyslogLogger(SyslogConfig{Network: SyslogUDP, Address: pc.LocalAddr().String(), Format: SyslogRFC3164, Facility: "local7", AppName: "goproxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	level.Error(s).Log("msg", "failed")
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one message per datagram, not octet counted
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<187>") || !strings.HasSuffix(msg, `: {"level":"error","msg":"failed"}`) {
+		t.Errorf("message %q", msg)
+	}
+}
+
+func TestSyslogUnreachableCollector(t *testing.T) {
+	// reserve a port nothing listens on until the queue overflowed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s, err := NewSyslogLogger(SyslogConfig{Network: SyslogTCP, Address: addr, Format: SyslogRFC5424, Facility: "daemon", AppName: "goproxy", QueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 6; i++ {
+		s.Log("msg", i)
+	}
+	if s.Connected() || s.Dropped() == 0 || s.Queued() != 2 {
+		t.Fatalf("connected %v dropped %d queued %d", s.Connected(), s.Dropped(), s.Queued())
+	}
+	dropped := s.Dropped()
+
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("port taken meanwhile: %v", err)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// the drop is reported first, then the newest messages are sent
+	notice, err := readOctetCounted(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf(`"dropped":%d}`, dropped); !strings.HasPrefix(notice, "<28>") || !strings.HasSuffix(notice, want) {
+		t.Errorf("notice %q, want %s", notice, want)
+	}
+	var last string
+	for !strings.HasSuffix(last, `{"msg":5}`) {
+		if last, err = readOctetCounted(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.Connected() {
+		t.Error("not connected after sending")
+	}
+}
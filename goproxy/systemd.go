@@ -0,0 +1,105 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFdsStart is the first file descriptor passed by socket activation
+// and by upgrades
+const sdListenFdsStart = 3
+
+// Notification states sent to systemd
+const (
+	SdNotifyReady    = "READY=1"
+	SdNotifyStopping = "STOPPING=1"
+	SdNotifyWatchdog = "WATCHDOG=1"
+)
+
+// SystemdListeners returns the sockets passed by systemd socket activation
+// grouped by their FileDescriptorName. It returns nil when the process was
+// not socket activated. The LISTEN_* variables are unset so that child
+// processes do not inherit them.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for len(names) < n {
+		names = append(names, "")
+	}
+	return fdListeners(names[:n])
+}
+
+// fdListeners returns listeners for the inherited fds starting at 3, one per
+// name. An empty name is reported as unknown.
+func fdListeners(names []string) (map[string][]net.Listener, error) {
+	listeners := make(map[string][]net.Listener)
+	for i, name := range names {
+		fd := sdListenFdsStart + i
+
+		if name == "" {
+			name = "unknown"
+		}
+		// FileListener works on a duplicate, closing f keeps the fd from leaking to children
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d (%s): %v", fd, name, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
+
+// SdNotify sends state to the service manager through NOTIFY_SOCKET. It
+// reports false without error when the process is not run by systemd with
+// Type=notify.
+func SdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// a leading @ denotes an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdogInterval returns the watchdog timeout systemd expects this process
+// to ping within, zero when the watchdog is disabled.
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
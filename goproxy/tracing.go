@@ -0,0 +1,469 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// W3C Trace Context headers
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// Span kinds as defined by OTLP
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+const (
+	flagSampled       = 0x01
+	exportBatchSize   = 256
+	exportQueueSize   = 4096
+	exportInterval    = 5 * time.Second
+	exportHTTPTimeout = 10 * time.Second
+)
+
+type traceContextKey int
+
+const (
+	remoteSpanContextKey traceContextKey = iota
+	activeSpanKey
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte
+	TraceState string
+}
+
+// IsValid reports whether both trace and span id are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the span is recorded by the caller
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// TraceIDString returns the hex encoded trace id
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// SpanIDString returns the hex encoded span id
+func (sc SpanContext) SpanIDString() string {
+	return hex.EncodeToString(sc.SpanID[:])
+}
+
+// Traceparent formats the span context as a version 00 traceparent header
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceIDString(), sc.SpanIDString(), sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent header value
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if !isLowerHex(parts[1]) || !isLowerHex(parts[2]) || !isLowerHex(parts[3]) {
+		return sc, false
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	sc.Flags = byte(flags)
+
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ContextWithRemoteSpanContext stores the span context received from a client
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanContextKey, sc)
+}
+
+// SpanFromContext returns the active span, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(activeSpanKey).(*Span)
+	return span
+}
+
+// Tracer creates spans and hands finished ones to the OTLP exporter
+type Tracer struct {
+	serviceName string
+	exporter    *otlpExporter
+}
+
+// NewTracer creates a tracer. Spans are exported to otlpEndpoint over OTLP/HTTP,
+// an empty endpoint only propagates trace context.
+func NewTracer(serviceName, otlpEndpoint string, logger log.Logger) *Tracer {
+	t := &Tracer{serviceName: serviceName}
+	if otlpEndpoint != "" {
+		t.exporter = newOTLPExporter(serviceName, otlpEndpoint, logger)
+	}
+	return t
+}
+
+// Close flushes spans waiting to be exported
+func (t *Tracer) Close() {
+	if t != nil && t.exporter != nil {
+		t.exporter.close()
+	}
+}
+
+// StartSpan starts a span as child of the active or remote span found in ctx,
+// or as root of a new trace.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]interface{}),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.sc = parent.sc
+		span.parentID = parent.sc.SpanID
+	} else if remote, ok := ctx.Value(remoteSpanContextKey).(SpanContext); ok && remote.IsValid() {
+		span.sc = remote
+		span.parentID = remote.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		if t.exporter != nil {
+			span.sc.Flags = flagSampled
+		}
+	}
+	rand.Read(span.sc.SpanID[:])
+
+	return context.WithValue(ctx, activeSpanKey, span), span
+}
+
+// StartSpan starts a child of the active span in ctx using its tracer. Without
+// an active span it returns a nil span, which is safe to use.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.StartSpan(ctx, name, kind)
+}
+
+// Span is a single timed operation of a trace
+type Span struct {
+	tracer   *Tracer
+	sc       SpanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	attrs  map[string]interface{}
+	errMsg string
+	ended  bool
+}
+
+// Context returns the span context
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records a key value pair on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export when sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+
+	if s.tracer.exporter != nil && s.sc.Sampled() {
+		s.tracer.exporter.export(s.toOTLP(time.Now()))
+	}
+}
+
+// traceLogKeyvals returns the trace and span id of the active span for log lines
+func traceLogKeyvals(ctx context.Context) []interface{} {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	return []interface{}{
+		"trace_id", span.sc.TraceIDString(),
+		"span_id", span.sc.SpanIDString(),
+	}
+}
+
+// injectTraceContext sets the traceparent and tracestate headers of an
+// outgoing request from the active span in ctx.
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	injectTraceHeaders(ctx, req.Header)
+}
+
+// injectTraceHeaders sets the W3C trace context of the active span in h
+func injectTraceHeaders(ctx context.Context, h http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	h.Set(TraceparentHeader, span.sc.Traceparent())
+	if span.sc.TraceState != "" {
+		h.Set(TracestateHeader, span.sc.TraceState)
+	}
+}
+
+// extractTraceContext reads the W3C trace context headers of an incoming request
+func extractTraceContext(ctx context.Context, r *http.Request) context.Context {
+	sc, ok := ParseTraceparent(r.Header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = r.Header.Get(TracestateHeader)
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// OTLP/HTTP JSON encoding
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func (s *Span) toOTLP(end time.Time) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           s.sc.TraceIDString(),
+		SpanID:            s.sc.SpanIDString(),
+		TraceState:        s.sc.TraceState,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttribute(k, v))
+	}
+	if s.errMsg != "" {
+		out.Status = otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	return out
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	var v map[string]interface{}
+	switch t := value.(type) {
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(t)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(t, 10)}
+	case bool:
+		v = map[string]interface{}{"boolValue": t}
+	case float64:
+		v = map[string]interface{}{"doubleValue": t}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(t)}
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
+
+// otlpExporter batches finished spans and posts them to an OTLP/HTTP collector.
+type otlpExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	logger      log.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan otlpSpan
+	done   chan struct{}
+}
+
+func newOTLPExporter(serviceName, endpoint string, logger log.Logger) *otlpExporter {
+	e := &otlpExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportHTTPTimeout},
+		logger:      logger,
+		queue:       make(chan otlpSpan, exportQueueSize),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) export(span otlpSpan) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- span:
+	default:
+		level.Debug(e.logger).Log("msg", "trace export queue full, dropping span")
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]otlpSpan, 0, exportBatchSize)
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *otlpExporter) send(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{otlpAttribute("service.name", e.serviceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": e.serviceName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		level.Error(e.logger).Log("msg", "failed to encode spans", "error_description", err.Error())
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		level.Error(e.logger).Log("msg", "failed to export spans", "error_description", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		level.Error(e.logger).Log("msg", "failed to export spans", "error_description", resp.Status)
+	}
+}
+
+func (e *otlpExporter) close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+	<-e.done
+}
@@ -0,0 +1,104 @@
+package goproxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"surrounding space", " 00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"later version with more fields", "01-" + traceID + "-" + spanID + "-01-extra", true, true},
+		{"version 00 with more fields", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		{"invalid version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"upper case hex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"short trace id", "00-4bf92f35-" + spanID + "-01", false, false},
+		{"short span id", "00-" + traceID + "-00f067aa-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span id", "00-" + traceID + "-0000000000000000-01", false, false},
+		{"non hex flags", "00-" + traceID + "-" + spanID + "-zz", false, false},
+		{"missing flags", "00-" + traceID + "-" + spanID, false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				if sc != (SpanContext{}) {
+					t.Errorf("invalid traceparent parsed to %+v", sc)
+				}
+				return
+			}
+			if sc.TraceIDString() != traceID || sc.SpanIDString() != spanID {
+				t.Errorf("ids %s %s, want %s %s", sc.TraceIDString(), sc.SpanIDString(), traceID, spanID)
+			}
+			if sc.Sampled() != tt.sampled {
+				t.Errorf("sampled = %v, want %v", sc.Sampled(), tt.sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	const value = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(value)
+	if !ok {
+		t.Fatal("not parsed")
+	}
+	if got := sc.Traceparent(); got != value {
+		t.Errorf("Traceparent = %s, want %s", got, value)
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	const value = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	incoming, _ := http.NewRequest("POST", "/task", nil)
+	incoming.Header.Set(TraceparentHeader, value)
+	incoming.Header.Set(TracestateHeader, "vendor=1")
+
+	tracer := NewTracer("test", "", nil)
+	ctx := extractTraceContext(context.Background(), incoming)
+	ctx, server := tracer.StartSpan(ctx, "server", SpanKindServer)
+	ctx, client := StartSpan(ctx, "client", SpanKindClient)
+
+	outgoing := make(http.Header)
+	injectTraceHeaders(ctx, outgoing)
+	sc, ok := ParseTraceparent(outgoing.Get(TraceparentHeader))
+	if !ok {
+		t.Fatalf("injected traceparent %q not valid", outgoing.Get(TraceparentHeader))
+	}
+
+	if sc.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id %s not kept", sc.TraceIDString())
+	}
+	if sc.SpanID != client.sc.SpanID || client.parentID != server.sc.SpanID || server.parentID != [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} {
+		t.Error("spans not linked to their parents")
+	}
+	if !sc.Sampled() {
+		t.Error("sampled flag of the caller not kept")
+	}
+	if got := outgoing.Get(TracestateHeader); got != "vendor=1" {
+		t.Errorf("tracestate %q, want vendor=1", got)
+	}
+
+	// without a caller or exporter a new trace is started, not sampled
+	_, root := tracer.StartSpan(context.Background(), "root", SpanKindServer)
+	if !root.sc.IsValid() || root.sc.Sampled() || root.parentID != [8]byte{} {
+		t.Errorf("root span %+v", root.sc)
+	}
+}
@@ -0,0 +1,245 @@
+package goproxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InFlightRequest is a task or stream being forwarded
+type InFlightRequest struct {
+	RequestID      string    `json:"request_id"`
+	Target         string    `json:"target"`
+	ClientIdentity string    `json:"client_identity,omitempty"`
+	Stream         bool      `json:"stream,omitempty"`
+	Started        time.Time `json:"started"`
+}
+
+// TargetState is what was observed forwarding to a target
+type TargetState struct {
+	Target   string `json:"target"`
+	Draining bool   `json:"draining"`
+	InFlight int    `json:"in_flight"`
+	Requests uint64 `json:"requests"`
+	// Failures counts the upstream failures since the last success.
+	Failures       int        `json:"consecutive_failures"`
+	LastStatus     int        `json:"last_upstream_status,omitempty"`
+	LastErrorCode  int        `json:"last_error_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastSeen       *time.Time `json:"last_seen,omitempty"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	ObservedHealth string     `json:"observed_health"`
+}
+
+// Observed health of a target, from the tasks forwarded to it
+const (
+	TargetHealthUnknown   = "unknown"
+	TargetHealthHealthy   = "healthy"
+	TargetHealthUnhealthy = "unhealthy"
+)
+
+// maxTrackedTargets bounds the targets a Tracker holds the state of. Clients
+// choose the targets, so the least recently seen idle ones are forgotten
+// beyond.
+const maxTrackedTargets = 1024
+
+// Tracker records the requests in flight and the outcome of the last
+// request per target, and holds the targets put into drain mode. Draining
+// targets take no new tasks or streams, in-flight ones complete.
+type Tracker struct {
+	mu       sync.Mutex
+	nextID   uint64
+	inFlight map[uint64]InFlightRequest
+	targets  map[string]*TargetState
+}
+
+// NewTracker returns an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		inFlight: make(map[uint64]InFlightRequest),
+		targets:  make(map[string]*TargetState),
+	}
+}
+
+// Begin records a request to target unless the target is draining. The
+// returned function must be called with the outcome once it completed.
+func (t *Tracker) Begin(request ReceiveAndForwardRequest, stream bool) (func(upstreamStatus int, err error), error) {
+	if t == nil {
+		return func(int, error) {}, nil
+	}
+	target := request.Body.TargetURL
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.stateLocked(target)
+	if state.Draining {
+		return nil, ErrTargetDraining
+	}
+	t.nextID++
+	id := t.nextID
+	t.inFlight[id] = InFlightRequest{
+		RequestID:      request.RequestID,
+		Target:         target,
+		ClientIdentity: request.ClientIdentity,
+		Stream:         stream,
+		Started:        time.Now().UTC(),
+	}
+	state.InFlight++
+
+	return func(upstreamStatus int, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.inFlight, id)
+		state.InFlight--
+		state.Requests++
+		now := time.Now().UTC()
+		state.LastSeen = &now
+		state.LastStatus = upstreamStatus
+		state.LastErrorCode, state.LastError = 0, ""
+
+		// client errors tell nothing about the target
+		if e := AsError(err); e != nil && e.Category != CategoryClient {
+			state.Failures++
+			state.LastErrorCode, state.LastError = e.Code, e.Error()
+			return
+		}
+		if upstreamStatus >= http.StatusInternalServerError {
+			state.Failures++
+			return
+		}
+		state.Failures = 0
+		state.LastSuccess = &now
+	}, nil
+}
+
+// InFlight returns the requests in flight, oldest first
+func (t *Tracker) InFlight() []InFlightRequest {
+	t.mu.Lock()
+	requests := make([]InFlightRequest, 0, len(t.inFlight))
+	for _, r := range t.inFlight {
+		requests = append(requests, r)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Started.Before(requests[j].Started)
+	})
+	return requests
+}
+
+// SetDraining puts target into drain mode, or takes it out
+func (t *Tracker) SetDraining(target string, draining bool) {
+	t.mu.Lock()
+	t.stateLocked(target).Draining = draining
+	t.mu.Unlock()
+}
+
+// Draining returns the targets in drain mode, sorted
+func (t *Tracker) Draining() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var targets []string
+	for name, state := range t.targets {
+		if state.Draining {
+			targets = append(targets, name)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Target returns the state of target
+func (t *Tracker) Target(target string) TargetState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state, ok := t.targets[target]; ok {
+		return withHealth(*state)
+	}
+	return withHealth(TargetState{Target: target})
+}
+
+// Targets returns the state of every target drained or recently seen, sorted
+// by name
+func (t *Tracker) Targets() []TargetState {
+	t.mu.Lock()
+	states := make([]TargetState, 0, len(t.targets))
+	for _, state := range t.targets {
+		states = append(states, withHealth(*state))
+	}
+	t.mu.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Target < states[j].Target
+	})
+	return states
+}
+
+func (t *Tracker) stateLocked(target string) *TargetState {
+	state, ok := t.targets[target]
+	if !ok {
+		if len(t.targets) >= maxTrackedTargets {
+			t.evictLocked()
+		}
+		state = &TargetState{Target: target}
+		t.targets[target] = state
+	}
+	return state
+}
+
+// evictLocked forgets the least recently seen target which is neither
+// draining nor has requests in flight
+func (t *Tracker) evictLocked() {
+	var oldest *TargetState
+	for _, state := range t.targets {
+		if state.Draining || state.InFlight > 0 {
+			continue
+		}
+		if oldest == nil || state.LastSeen == nil || (oldest.LastSeen != nil && state.LastSeen.Before(*oldest.LastSeen)) {
+			oldest = state
+			if state.LastSeen == nil {
+				break
+			}
+		}
+	}
+	if oldest != nil {
+		delete(t.targets, oldest.Target)
+	}
+}
+
+func withHealth(state TargetState) TargetState {
+	switch {
+	case state.Requests == 0:
+		state.ObservedHealth = TargetHealthUnknown
+	case state.Failures > 0:
+		state.ObservedHealth = TargetHealthUnhealthy
+	default:
+		state.ObservedHealth = TargetHealthHealthy
+	}
+	return state
+}
+
+type trackingMiddleware struct {
+	tracker *Tracker
+	next    Service
+}
+
+func (tmw *trackingMiddleware) ReceiveAndForward(ctx context.Context, request ReceiveAndForwardRequest) (ReceiveAndForwardResponse, error) {
+	done, err := tmw.tracker.Begin(request, false)
+	if err != nil {
+		e := AsError(err)
+		return setReceiveAndForwardResponse(e), e
+	}
+	output, err := tmw.next.ReceiveAndForward(ctx, request)
+	done(output.UpstreamStatus, err)
+	return output, err
+}
+
+func (tmw *trackingMiddleware) HealthCheck(ctx context.Context, request HealthCheckRequest) (HealthCheckResponse, error) {
+	return tmw.next.HealthCheck(ctx, request)
+}
+
+func (tmw *trackingMiddleware) Version(ctx context.Context) (VersionResponse, error) {
+	return tmw.next.Version(ctx)
+}
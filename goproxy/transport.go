@@ -1,10 +1,11 @@
 package goproxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/json"
-	"errors"
-	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
@@ -13,12 +14,27 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// HTTPConfig holds the settings of the HTTP transport
+type HTTPConfig struct {
+	// RequestIDPrefix is prepended to generated request ids, usually a node identifier.
+	RequestIDPrefix string
+	// StreamHandler serves StreamEndpoint on the mutual TLS listener when set.
+	StreamHandler http.Handler
+	// AdminHandler serves AdminPathPrefix on the monitoring listener when set.
+	AdminHandler http.Handler
+	// MetricsHandler serves MetricsEndpoint on the monitoring listener when set.
+	MetricsHandler http.Handler
+	// AccessLog logs the requests of both handlers when set.
+	AccessLog *AccessLog
+}
+
 // MakeHTTPHandler returns an http handler for the endpoints
-func MakeHTTPHandler(endpoints Endpoints) (http.Handler, http.Handler) {
+func MakeHTTPHandler(endpoints Endpoints, config HTTPConfig) (http.Handler, http.Handler) {
 	r := mux.NewRouter()
 	r1 := mux.NewRouter()
 
 	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, extractTraceContext),
 		httptransport.ServerErrorEncoder(encodeError),
 	}
 	receiveAndForwardHandler := httptransport.NewServer(
@@ -29,13 +45,26 @@ func MakeHTTPHandler(endpoints Endpoints) (http.Handler, http.Handler) {
 	)
 	r.Methods("POST").Path("/task").Handler(receiveAndForwardHandler)
 
-	healthCheckHandler := httptransport.NewServer(
+	if config.StreamHandler != nil {
+		r.Path(StreamEndpoint).Handler(config.StreamHandler)
+	}
+
+	livenessHandler := httptransport.NewServer(
 		endpoints.HealthCheck,
-		decodeHealthCheckRequest,
-		encodeGenericResponse,
+		decodeHealthCheckRequest(ProbeLiveness),
+		encodeHealthCheckResponse,
 		options...,
 	)
-	r1.Methods("GET").Path("/health").Handler(healthCheckHandler)
+	r1.Methods("GET").Path(LivenessEndpoint).Handler(livenessHandler)
+	r1.Methods("GET").Path(HealthEndpoint).Handler(livenessHandler)
+
+	readinessHandler := httptransport.NewServer(
+		endpoints.HealthCheck,
+		decodeHealthCheckRequest(ProbeReadiness),
+		encodeHealthCheckResponse,
+		options...,
+	)
+	r1.Methods("GET").Path(ReadinessEndpoint).Handler(readinessHandler)
 
 	versionHandler := httptransport.NewServer(
 		endpoints.Version,
@@ -45,13 +74,25 @@ func MakeHTTPHandler(endpoints Endpoints) (http.Handler, http.Handler) {
 	)
 	r1.Methods("GET").Path("/version").Handler(versionHandler)
 
-	return r, r1
+	if config.AdminHandler != nil {
+		r1.PathPrefix(AdminPathPrefix).Handler(config.AdminHandler)
+	}
+	if config.MetricsHandler != nil {
+		r1.Methods("GET").Path(MetricsEndpoint).Handler(config.MetricsHandler)
+	}
+
+	var mutualTLSHandler, nonMutualTLSHandler http.Handler = r, r1
+	if config.AccessLog != nil {
+		mutualTLSHandler = config.AccessLog.Handler(AccessLogTask, r)
+		nonMutualTLSHandler = config.AccessLog.Handler(AccessLogMonitoring, r1)
+	}
+	return requestIDHandler(config.RequestIDPrefix, mutualTLSHandler), requestIDHandler(config.RequestIDPrefix, nonMutualTLSHandler)
 }
 
 func copyHeaders(req ReceiveAndForwardRequest, r *http.Request) ReceiveAndForwardRequest {
 
 	req.Headers.Authorization = r.Header.Get("Authorization")
-	req.Headers.RequestID = r.Header.Get("x-request-id")
+	req.Headers.RequestID = r.Header.Get(RequestIDHeader)
 	req.Headers.ContentType = r.Header.Get("Content-Type")
 
 	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
@@ -61,21 +102,43 @@ func copyHeaders(req ReceiveAndForwardRequest, r *http.Request) ReceiveAndForwar
 		req.Headers.XForwardedFor = clientIP
 	}
 
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		req.ClientIdentity = certIdentity(r.TLS.PeerCertificates[0])
+	}
+
 	return req
 }
 
+// certIdentity returns the common name of a client certificate, falling back
+// to the full subject when no common name is set.
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
 func decodeReceiveAndForwardRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	var req ReceiveAndForwardRequest
-	if e := json.NewDecoder(r.Body).Decode(&req.Body); e != nil {
-		switch {
-		case e == io.EOF:
-			return nil, ErrEmptyRequestBody
-		default:
-			return nil, ErrMalformedRequest
-		}
-	}
 	defer r.Body.Close()
 
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, ErrMalformedRequest.Wrap(err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, ErrEmptyRequestBody
+	}
+
+	// unsupported content types are decoded as JSON and rejected by validation
+	codec, ok := EnvelopeCodecFor(r.Header.Get("Content-Type"))
+	if !ok {
+		codec = jsonEnvelopeCodec{}
+	}
+	if req.Body, err = codec.Decode(data); err != nil {
+		return nil, ErrMalformedRequest.Wrap(err)
+	}
+
 	// copy headers from incoming request for logging and forwarding purposes
 	// also request-id is good candidates for context package.
 	req = copyHeaders(req, r)
@@ -85,7 +148,7 @@ func decodeReceiveAndForwardRequest(_ context.Context, r *http.Request) (interfa
 	if len(isBeta) > 0 {
 		beta, err := strconv.ParseBool(isBeta)
 		if err != nil {
-			return "", err
+			return nil, ErrMalformedRequest.Wrap(err)
 		}
 		req.QueryString.IsBeta = beta
 	}
@@ -93,7 +156,7 @@ func decodeReceiveAndForwardRequest(_ context.Context, r *http.Request) (interfa
 	return req, nil
 }
 
-func encodeReceiveAndForwardResponse(_ context.Context, w http.ResponseWriter, resp interface{}) error {
+func encodeReceiveAndForwardResponse(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
 	if e, ok := resp.(errorer); ok && e.error() != nil {
 		w.WriteHeader(codeFrom(e.error()))
 		json.NewEncoder(w).Encode(resp.(ReceiveAndForwardResponse))
@@ -101,22 +164,23 @@ func encodeReceiveAndForwardResponse(_ context.Context, w http.ResponseWriter, r
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-	httpStatusText := ErrInternalServerError
+	httpStatusCode := http.StatusInternalServerError
 	jsonResponse := make(map[string]interface{})
 
 	if response, ok := resp.(ReceiveAndForwardResponse); ok {
 
+		if response.CacheStatus != "" {
+			w.Header().Set("X-Cache", response.CacheStatus)
+		}
+
 		if response.Reason != "" {
 			jsonResponse["reason"] = response.Reason
 		}
 
-		if response.Status > 0 {
-			httpStatus := strconv.Itoa(response.Status)
-			httpStatusText = errors.New(httpStatus)
+		if response.Status > 0 && http.StatusText(response.Status) != "" {
+			httpStatusCode = response.Status
 		} else if err := response.ErrorDescription; err != nil {
-			httpStatusText = response.ErrorDescription
-		} else {
-			httpStatusText = ErrInternalServerError
+			httpStatusCode = codeFrom(err)
 		}
 
 		if response.Message != nil {
@@ -134,9 +198,35 @@ func encodeReceiveAndForwardResponse(_ context.Context, w http.ResponseWriter, r
 				jsonResponse["error"] = response.Error
 			}
 		}
+
+		if err := response.ErrorDescription; err != nil {
+			setErrorFields(jsonResponse, AsError(err))
+		}
+
+		if response.UpstreamStatus != 0 && httpStatusCode >= http.StatusBadRequest {
+			jsonResponse["upstream_status"] = response.UpstreamStatus
+		}
+
+		if httpStatusCode >= http.StatusBadRequest {
+			source := response.ErrorSource
+			if source == "" {
+				source = ErrorSourceProxy
+			}
+			w.Header().Set(ErrorSourceHeader, source)
+		}
+
+		if httpStatusCode >= http.StatusBadRequest && acceptsProblemJSON(ctx) {
+			var e *Error
+			if response.ErrorDescription != nil {
+				e = AsError(response.ErrorDescription)
+			}
+			p := newProblem(ctx, httpStatusCode, e, response.Reason)
+			p.Target = response.Target
+			p.UpstreamStatus = response.UpstreamStatus
+			return encodeProblem(w, p)
+		}
 	}
 
-	httpStatusCode := codeFrom(httpStatusText)
 	w.WriteHeader(httpStatusCode)
 
 	jsonResponse["status"] = httpStatusCode
@@ -147,8 +237,23 @@ func encodeReceiveAndForwardResponse(_ context.Context, w http.ResponseWriter, r
 	return json.NewEncoder(w).Encode(jsonResponse)
 }
 
-func decodeHealthCheckRequest(_ context.Context, _ *http.Request) (interface{}, error) {
-	return HealthCheckRequest{}, nil
+// decodeHealthCheckRequest decodes a request of probe, ?verbose adds the
+// details of every check
+func decodeHealthCheckRequest(probe string) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		req := HealthCheckRequest{Probe: probe}
+		if values, ok := r.URL.Query()["verbose"]; ok {
+			req.Verbose = true
+			if v := values[0]; v != "" {
+				verbose, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, ErrMalformedRequest.Wrap(err)
+				}
+				req.Verbose = verbose
+			}
+		}
+		return req, nil
+	}
 }
 func decodeVersionRequest(_ context.Context, _ *http.Request) (interface{}, error) {
 	return VersionRequest{}, nil
@@ -167,39 +272,55 @@ func encodeGenericResponse(ctx context.Context, w http.ResponseWriter, resp inte
 	return json.NewEncoder(w).Encode(resp)
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+// encodeHealthCheckResponse answers 503 when a check failed
+func encodeHealthCheckResponse(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
+	if e, ok := resp.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if response, ok := resp.(HealthCheckResponse); ok && response.Status != HealthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	encodeErrorFrom(ctx, err, ErrorSourceProxy, w)
+}
+
+// encodeErrorFrom encodes err as raised by source, one of the ErrorSource values
+func encodeErrorFrom(ctx context.Context, err error, source string, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
+	e := AsError(err)
+	w.Header().Set(ErrorSourceHeader, source)
+	if acceptsProblemJSON(ctx) {
+		encodeProblem(w, newProblem(ctx, e.HTTPStatus, e, e.Message))
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	httpStatusCode := codeFrom(err)
-	w.WriteHeader(httpStatusCode)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  httpStatusCode,
-		"message": http.StatusText(httpStatusCode),
-		"reason":  err.Error(),
-	})
+	w.WriteHeader(e.HTTPStatus)
+	jsonResponse := map[string]interface{}{
+		"status":  e.HTTPStatus,
+		"message": http.StatusText(e.HTTPStatus),
+		"reason":  e.Message,
+	}
+	setErrorFields(jsonResponse, e)
+	json.NewEncoder(w).Encode(jsonResponse)
+}
+
+// setErrorFields adds the stable error code, category and retryable flag to a
+// JSON error body.
+func setErrorFields(jsonResponse map[string]interface{}, e *Error) {
+	jsonResponse["error"] = e.Code
+	jsonResponse["category"] = e.Category
+	jsonResponse["retryable"] = e.Retryable
 }
 
 func codeFrom(err error) int {
-	switch err {
-	case ErrJSONUnMarshall, ErrMissingTargetURL, ErrEmptyRequestBody, ErrMalformedRequest,
-		ErrBadUpstreamURL:
-		return http.StatusBadRequest
-	case ErrInvalidContentType:
-		return http.StatusUnsupportedMediaType
-	case ErrInternalServerError, ErrFailedCreatingNewRequest,
-		ErrReadingResponseBody, ErrTypeAssertion:
-		return http.StatusInternalServerError
-	case ErrRequestTimeout, ErrUpstreamHealthCheckFailed:
-		return http.StatusServiceUnavailable
-	default:
-		if statusText := ValidHTTPStatusCode(err.Error()); statusText != "" {
-			code, _ := strconv.Atoi(err.Error())
-			return code
-		}
-		return http.StatusInternalServerError
-	}
+	return AsError(err).HTTPStatus
 }
 
 // ValidHTTPStatusCode takes in a string and return true if the string can
@@ -0,0 +1,159 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeFdNamesEnv lists the names of the listeners passed to a process
+// started by Upgrade, colon separated like LISTEN_FDNAMES. The fd after the
+// listeners is a pipe the new process writes to once it is ready.
+const upgradeFdNamesEnv = "GOPROXY_UPGRADE_FDNAMES"
+
+// ErrUpgraded is returned once the listeners were handed over to a new process
+var ErrUpgraded = errors.New("upgraded to a new process")
+
+// Upgrade starts the executable of this process again with the same
+// arguments and hands it the listeners by name. It returns once the new
+// process called UpgradeReady, or kills it and returns an error when it exits
+// or is not ready within timeout. This process keeps serving on error.
+func Upgrade(listeners map[string][]net.Listener, timeout time.Duration) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for name, ls := range listeners {
+		for _, l := range ls {
+			fl, ok := l.(interface{ File() (*os.File, error) })
+			if !ok {
+				return 0, fmt.Errorf("listener %s of %s cannot be passed on", l.Addr(), name)
+			}
+			f, err := fl.File()
+			if err != nil {
+				return 0, err
+			}
+			names = append(names, name)
+			files = append(files, f)
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, kv := range os.Environ() {
+		// WATCHDOG_PID names this process, the new one must ping the
+		// watchdog itself once it took over
+		if !strings.HasPrefix(kv, upgradeFdNamesEnv+"=") && !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeFdNamesEnv+"="+strings.Join(names, ":"))
+
+	err = cmd.Start()
+	// only the new process may hold the write end, so exiting closes the pipe
+	w.Close()
+	// passing the files put the sockets, shared with our listeners, in blocking mode
+	for _, f := range files {
+		syscall.SetNonblock(int(f.Fd()), true)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			ready <- errors.New("new process exited before it was ready")
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = fmt.Errorf("new process not ready within %s", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+
+	// the socket files now belong to the new process
+	for _, ls := range listeners {
+		for _, l := range ls {
+			if ul, ok := l.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+	}
+	return cmd.Process.Pid, nil
+}
+
+// InheritedListeners returns the listeners handed over by Upgrade grouped by
+// name. It returns nil when the process was not started by an upgrade.
+func InheritedListeners() (map[string][]net.Listener, error) {
+	v, ok := os.LookupEnv(upgradeFdNamesEnv)
+	if !ok {
+		return nil, nil
+	}
+	var names []string
+	if v != "" {
+		names = strings.Split(v, ":")
+	}
+	listeners, err := fdListeners(names)
+	if err != nil {
+		return nil, err
+	}
+
+	// unix sockets are removed on exit again, unless handed over in turn
+	for _, ls := range listeners {
+		for _, l := range ls {
+			if ul, ok := l.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(true)
+			}
+		}
+	}
+	return listeners, nil
+}
+
+// UpgradeReady tells the process that started this one through Upgrade that
+// all listeners are served. It does nothing when the process was not started
+// by an upgrade.
+func UpgradeReady() error {
+	v, ok := os.LookupEnv(upgradeFdNamesEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(upgradeFdNamesEnv)
+
+	n := 0
+	if v != "" {
+		n = len(strings.Split(v, ":"))
+	}
+	f := os.NewFile(uintptr(sdListenFdsStart+n), "upgrade-ready")
+	defer f.Close()
+	_, err := f.Write([]byte{1})
+	return err
+}
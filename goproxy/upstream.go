@@ -0,0 +1,604 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Upstream protocols selectable per target
+const (
+	// ProtocolHTTP1 forwards over HTTPS with HTTP/1.1, the default
+	ProtocolHTTP1 = "http1"
+	// ProtocolHTTP2 forwards over HTTPS and fails unless upstream negotiates HTTP/2
+	ProtocolHTTP2 = "h2"
+	// ProtocolH2C forwards over cleartext HTTP/2 with prior knowledge
+	ProtocolH2C = "h2c"
+	// ProtocolGRPC sends the JSON task as a unary call to the target's method
+	ProtocolGRPC = "grpc"
+)
+
+// UpstreamTarget selects how tasks for a target are forwarded
+type UpstreamTarget struct {
+	Protocol string
+	// GRPCMethod is the full method name, /package.Service/Method, called for grpc targets.
+	GRPCMethod string
+	// Timeout replaces DefaultTimeout for the target when set.
+	Timeout time.Duration
+	// Headers are set on the tasks forwarded to the target, replacing request
+	// headers of the same name. They are sent as metadata to grpc targets.
+	Headers http.Header
+}
+
+// ParseUpstreamTarget parses a protocol, with the method appended for gRPC
+// targets, e.g. h2c or grpc:/tasks.Worker/Run.
+func ParseUpstreamTarget(s string) (UpstreamTarget, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	target := UpstreamTarget{Protocol: strings.ToLower(parts[0])}
+
+	switch target.Protocol {
+	case ProtocolHTTP1, ProtocolHTTP2, ProtocolH2C:
+		if len(parts) == 2 {
+			return target, fmt.Errorf("protocol %s does not take a method", target.Protocol)
+		}
+	case ProtocolGRPC:
+		if len(parts) != 2 || !validGRPCMethod(parts[1]) {
+			return target, fmt.Errorf("grpc protocol needs a method like grpc:/package.Service/Method")
+		}
+		target.GRPCMethod = parts[1]
+	default:
+		return target, fmt.Errorf("unknown upstream protocol %q", parts[0])
+	}
+	return target, nil
+}
+
+func validGRPCMethod(method string) bool {
+	parts := strings.Split(method, "/")
+	return len(parts) == 3 && parts[0] == "" && parts[1] != "" && parts[2] != ""
+}
+
+// Upstreams holds the per target protocol config and the clients used for
+// HTTP/2, h2c and gRPC targets. A nil *Upstreams forwards everything over HTTP/1.1.
+type Upstreams struct {
+	targets   map[string]UpstreamTarget
+	tlsConfig *tls.Config
+	http2     *http.Client
+	h2c       *http.Client
+	creds     credentials.TransportCredentials
+	counter   *connCounter
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewUpstreams creates the upstream clients. They trust the same CAs as MakeTLSClient.
+func NewUpstreams(caFiles []string, targets map[string]UpstreamTarget) (*Upstreams, error) {
+	tlsConfig, err := upstreamTLSConfig(caFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := &connCounter{
+		dialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		open:   make(map[string]int),
+	}
+	return &Upstreams{
+		targets:   targets,
+		tlsConfig: tlsConfig,
+		http2: &http.Client{
+			Timeout: DefaultTimeout,
+			Transport: &http2.Transport{
+				TLSClientConfig: tlsConfig.Clone(),
+				DialTLS:         counter.dialHTTP2,
+			},
+		},
+		h2c: &http.Client{
+			Timeout: DefaultTimeout,
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					return counter.DialContext(context.Background(), network, addr)
+				},
+			},
+		},
+		creds:   credentials.NewTLS(tlsConfig.Clone()),
+		counter: counter,
+		conns:   make(map[string]*grpc.ClientConn),
+	}, nil
+}
+
+// Targets returns the names of the targets with a protocol config, sorted
+func (u *Upstreams) Targets() []string {
+	if u == nil {
+		return nil
+	}
+	names := make([]string, 0, len(u.targets))
+	for name := range u.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Target returns the protocol config of target, HTTP/1.1 when none is set
+func (u *Upstreams) Target(target string) UpstreamTarget {
+	if u != nil {
+		if t, ok := u.targets[target]; ok {
+			return t
+		}
+	}
+	return UpstreamTarget{Protocol: ProtocolHTTP1}
+}
+
+// httpClient returns the client and URL scheme of an HTTP based target
+func (u *Upstreams) httpClient(target UpstreamTarget, http1 *http.Client) (*http.Client, string) {
+	client, scheme := http1, DefaultUpstreamScheme
+	switch {
+	case u == nil:
+	case target.Protocol == ProtocolHTTP2:
+		client = u.http2
+	case target.Protocol == ProtocolH2C:
+		client, scheme = u.h2c, "http"
+	}
+	if target.Timeout > 0 {
+		targetClient := *client
+		targetClient.Timeout = target.Timeout
+		client = &targetClient
+	}
+	return client, scheme
+}
+
+// streamTLSConfig returns the TLS config of the stream clients, the system
+// roots when u is nil
+func (u *Upstreams) streamTLSConfig() *tls.Config {
+	if u == nil {
+		config, _ := upstreamTLSConfig(nil)
+		return config
+	}
+	return u.tlsConfig
+}
+
+// dialContext dials an upstream connection, counted unless u is nil
+func (u *Upstreams) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if u == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return u.counter.DialContext(ctx, network, addr)
+}
+
+// conn returns the shared gRPC connection to address
+func (u *Upstreams) conn(address string) (*grpc.ClientConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if conn, ok := u.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(u.creds),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return u.counter.DialContext(ctx, "tcp", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	u.conns[address] = conn
+	return conn, nil
+}
+
+// CountConnections counts the connections of client, an HTTP/1.1 client
+// made by MakeTLSClient, along with those of the upstream clients
+func (u *Upstreams) CountConnections(client *http.Client) {
+	if u == nil {
+		return
+	}
+	if tr, ok := client.Transport.(*http.Transport); ok {
+		tr.DialContext = u.counter.DialContext
+	}
+}
+
+// ObserveCertificates passes the certificates presented by upstream to
+// monitor, for client, an HTTP/1.1 client made by MakeTLSClient, and the
+// upstream clients. It must be called before any request is forwarded.
+func (u *Upstreams) ObserveCertificates(client *http.Client, monitor *CertMonitor) {
+	if u == nil {
+		return
+	}
+	u.tlsConfig.VerifyConnection = monitor.ObserveUpstream
+	if tr, ok := u.http2.Transport.(*http2.Transport); ok {
+		tr.TLSClientConfig.VerifyConnection = monitor.ObserveUpstream
+	}
+	u.creds = credentials.NewTLS(u.tlsConfig.Clone())
+	if tr, ok := client.Transport.(*http.Transport); ok && tr.TLSClientConfig != nil {
+		tr.TLSClientConfig.VerifyConnection = monitor.ObserveUpstream
+	}
+}
+
+// UpstreamConnections are the open connections to an upstream address
+type UpstreamConnections struct {
+	Address string `json:"address"`
+	Open    int    `json:"open"`
+	// GRPCState is the state of the shared connection of grpc targets.
+	GRPCState string `json:"grpc_state,omitempty"`
+}
+
+// Connections returns the open connections per upstream address, sorted
+func (u *Upstreams) Connections() []UpstreamConnections {
+	if u == nil {
+		return nil
+	}
+	open := u.counter.counts()
+
+	u.mu.Lock()
+	states := make(map[string]string, len(u.conns))
+	for address, conn := range u.conns {
+		states[address] = strings.ToLower(conn.GetState().String())
+		if _, ok := open[address]; !ok {
+			open[address] = 0
+		}
+	}
+	u.mu.Unlock()
+
+	connections := make([]UpstreamConnections, 0, len(open))
+	for address, n := range open {
+		connections = append(connections, UpstreamConnections{
+			Address:   address,
+			Open:      n,
+			GRPCState: states[address],
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Address < connections[j].Address
+	})
+	return connections
+}
+
+// Close closes the gRPC connections
+func (u *Upstreams) Close() error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for address, conn := range u.conns {
+		conn.Close()
+		delete(u.conns, address)
+	}
+	return nil
+}
+
+// connCounter dials upstream connections and counts them per address until
+// they are closed
+type connCounter struct {
+	dialer *net.Dialer
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func (c *connCounter) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := c.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.open[addr]++
+	c.mu.Unlock()
+	return &countedConn{Conn: conn, release: func() {
+		c.mu.Lock()
+		if c.open[addr]--; c.open[addr] <= 0 {
+			delete(c.open, addr)
+		}
+		c.mu.Unlock()
+	}}, nil
+}
+
+// dialHTTP2 is the DialTLS of the h2 client, with the ALPN check of the
+// http2 package's default
+func (c *connCounter) dialHTTP2(network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := c.DialContext(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, fmt.Errorf("http2: unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)
+	}
+	return tlsConn, nil
+}
+
+func (c *connCounter) counts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(c.open))
+	for addr, n := range c.open {
+		counts[addr] = n
+	}
+	return counts
+}
+
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// ProbeUpstream runs the health check preceding every forwarded task against
+// target, over the protocol and client configured for it. It returns the
+// status upstream answered with, zero when no response was received.
+func ProbeUpstream(ctx context.Context, target, upstreamPort string, upstreamClient *http.Client, upstreams *Upstreams) (int, error) {
+	t := upstreams.Target(target)
+	if t.Protocol == ProtocolGRPC {
+		conn, err := upstreams.conn(target + upstreamPort)
+		if err != nil {
+			return 0, ErrFailedCreatingNewRequest.Wrap(err)
+		}
+		timeout := DefaultTimeout
+		if t.Timeout > 0 {
+			timeout = t.Timeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		// zero when the upstream does not implement the health service
+		code, e := testGRPCUpstreamHealth(ctx, conn)
+		if e != nil {
+			return code, e
+		}
+		return code, nil
+	}
+
+	client, scheme := upstreams.httpClient(t, upstreamClient)
+	if status, e := testUpstreamHealth(ctx, scheme+"://"+target, upstreamPort, client); e != nil {
+		return status, e
+	}
+	return http.StatusOK, nil
+}
+
+// forwardGRPC sends the task as a JSON transcoded unary call. A response is
+// returned as the message, an error status answered by upstream as the
+// equivalent HTTP status.
+func (svc service) forwardGRPC(ctx context.Context, request ReceiveAndForwardRequest, task []byte, target UpstreamTarget) (ReceiveAndForwardResponse, error) {
+	var rf ReceiveAndForwardResponse
+
+	contentType := request.ContentType
+	if request.Body.TaskContentType != "" {
+		contentType = request.Body.TaskContentType
+	}
+	if !isJSONMediaType(contentType) {
+		e := ErrInvalidContentType.Wrap(fmt.Errorf("grpc targets take JSON tasks, got %q", contentType))
+		return setReceiveAndForwardResponse(e), e
+	}
+
+	conn, err := svc.upstreams.conn(request.Body.TargetURL + svc.upstreamPort)
+	if err != nil {
+		e := ErrFailedCreatingNewRequest.Wrap(err)
+		return setReceiveAndForwardResponse(e), e
+	}
+
+	timeout := DefaultTimeout
+	if target.Timeout > 0 {
+		timeout = target.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	md := grpcUpstreamMetadata(request)
+	for name, values := range target.Headers {
+		md.Set(name, values...)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	if code, err := testGRPCUpstreamHealth(ctx, conn); err != nil {
+		rf = setReceiveAndForwardResponse(err)
+		rf.ErrorSource = ErrorSourceHealth
+		rf.UpstreamStatus = code
+		return rf, err
+	}
+
+	method := target.GRPCMethod
+	ctx, span := StartSpan(ctx, "upstream gRPC "+method, SpanKindClient)
+	defer span.End()
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", method)
+	span.SetAttribute("upstream.protocol", ProtocolGRPC)
+	ctx = injectGRPCTraceContext(ctx)
+
+	in := json.RawMessage(task)
+	var out json.RawMessage
+	var header metadata.MD
+	err = conn.Invoke(ctx, method, &in, &out, grpc.ForceCodec(rawJSONCodec{}), grpc.CallContentSubtype(rawJSONCodec{}.Name()), grpc.Header(&header))
+	if err != nil {
+		span.SetError(err)
+		st := status.Convert(err)
+		span.SetAttribute("rpc.grpc.status_code", int(st.Code()))
+		if e := classifyGRPCError(st); e != nil {
+			rf = setReceiveAndForwardResponse(e)
+			rf.ErrorSource = ErrorSourceUpstream
+			return rf, e
+		}
+		rf.Status = httpStatusFromGRPCCode(st.Code())
+		rf.Reason = st.Message()
+		rf.UpstreamStatus = rf.Status
+		rf.ErrorSource = ErrorSourceUpstream
+		return rf, nil
+	}
+
+	rf.Status = http.StatusOK
+	rf.UpstreamStatus = http.StatusOK
+	rf.Message = &out
+	rf.UpstreamHeader = make(http.Header, len(header))
+	for k, values := range header {
+		for _, v := range values {
+			rf.UpstreamHeader.Add(k, v)
+		}
+	}
+	return rf, nil
+}
+
+// testGRPCUpstreamHealth runs the standard gRPC health check. Upstreams which
+// do not implement it are taken as healthy.
+func testGRPCUpstreamHealth(ctx context.Context, conn *grpc.ClientConn) (int, *Error) {
+	ctx, span := StartSpan(ctx, "upstream health check", SpanKindClient)
+	defer span.End()
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", "/grpc.health.v1.Health/Check")
+	ctx = injectGRPCTraceContext(ctx)
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		st := status.Convert(err)
+		if st.Code() == codes.Unimplemented {
+			return 0, nil
+		}
+		span.SetError(err)
+		if e := classifyGRPCError(st); e != nil {
+			return 0, e
+		}
+		return httpStatusFromGRPCCode(st.Code()), ErrUpstreamHealthCheckFailed.Wrap(err)
+	}
+
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		span.SetError(ErrUpstreamHealthCheckFailed)
+		return http.StatusServiceUnavailable, ErrUpstreamHealthCheckFailed.Wrap(fmt.Errorf("upstream reported %s", resp.GetStatus()))
+	}
+	return http.StatusOK, nil
+}
+
+// grpcUpstreamMetadata carries the headers setHeaders forwards to HTTP upstreams
+func grpcUpstreamMetadata(request ReceiveAndForwardRequest) metadata.MD {
+	md := metadata.MD{}
+	if request.Authorization != "" {
+		md.Set("authorization", request.Authorization)
+	}
+	if request.XForwardedFor != "" {
+		md.Set("x-forwarded-for", request.XForwardedFor)
+	}
+	if request.RequestID != "" {
+		md.Set(RequestIDHeader, request.RequestID)
+	}
+	return md
+}
+
+// injectGRPCTraceContext adds the W3C trace context of the active span to the outgoing metadata
+func injectGRPCTraceContext(ctx context.Context) context.Context {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return ctx
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, TraceparentHeader, span.sc.Traceparent())
+	if span.sc.TraceState != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, TracestateHeader, span.sc.TraceState)
+	}
+	return ctx
+}
+
+// classifyGRPCError maps statuses raised by the gRPC client, rather than
+// answered by upstream, onto the error catalog. It returns nil for the rest.
+func classifyGRPCError(st *status.Status) *Error {
+	err := st.Err()
+	msg := st.Message()
+
+	switch st.Code() {
+	case codes.DeadlineExceeded:
+		return ErrRequestTimeout.Wrap(err)
+	case codes.Unavailable:
+		switch {
+		case strings.Contains(msg, "no such host"):
+			return ErrBadUpstreamURL.Wrap(err)
+		case strings.Contains(msg, "connection refused"):
+			return ErrUpstreamConnectionRefused.Wrap(err)
+		case strings.Contains(msg, "connection reset by peer"):
+			return ErrUpstreamConnectionReset.Wrap(err)
+		case strings.Contains(msg, "tls: "), strings.Contains(msg, "x509: "), strings.Contains(msg, "authentication handshake failed"):
+			return ErrUpstreamTLSHandshake.Wrap(err)
+		}
+		return ErrUpstreamRequestFailed.Wrap(err)
+	}
+	return nil
+}
+
+// httpStatusFromGRPCCode maps a gRPC status code to the HTTP status reported to clients
+func httpStatusFromGRPCCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == MediaTypeJSON || strings.HasSuffix(mediaType, "+json"))
+}
+
+// rawJSONCodec passes JSON payloads through gRPC unchanged
+type rawJSONCodec struct{}
+
+func (rawJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(*json.RawMessage)
+	if !ok {
+		return nil, fmt.Errorf("rawJSONCodec: unexpected type %T", v)
+	}
+	return *msg, nil
+}
+
+func (rawJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*json.RawMessage)
+	if !ok {
+		return fmt.Errorf("rawJSONCodec: unexpected type %T", v)
+	}
+	*msg = append((*msg)[:0], data...)
+	return nil
+}
+
+func (rawJSONCodec) Name() string {
+	return "json"
+}